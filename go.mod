@@ -0,0 +1,3 @@
+module github.com/samiahlroos/l2q
+
+go 1.21
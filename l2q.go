@@ -3,120 +3,3388 @@ package main
 import (
 	"bytes"
 	"bufio"
+	"compress/gzip"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// stats holds the counters reported by -stats.
+var stats = struct {
+	lines, json, legacy, queries int
+	parsed, unparsed             int // entries whose namespace and command could or couldn't be extracted
+	operations                   map[string]int
+	durations                    []int // per durationBuckets entry, plus one for slower queries
+}{operations: map[string]int{}, durations: make([]int, len(durationBuckets)+1)}
+
+// durationBuckets are the upper bounds, in milliseconds, of the -stats
+// duration histogram: <10ms, 10ms-100ms, 100ms-1s and >=1s.
+var durationBuckets = []int64{10, 100, 1000}
+
+// Config holds the options that control a conversion. It isn't passed to the
+// handlers, which read the global config: the subcommands bind their flags to
+// its fields, and convert installs a Config built in code, as the tests do.
+// Zero fields keep the default behaviour, except for those defaultConfig sets.
+type Config struct {
+	// Input and selection.
+
+	// InputFormat is "json" or "legacy" to skip the per-line format detection
+	// of the default "auto" on a log known to hold one format.
+	InputFormat string
+	// MultilineJSON reads the input as a stream of JSON entries regardless of
+	// line breaks, for logs pretty-printed one entry over many lines.
+	MultilineJSON bool
+	// CommandPath is the -command-json-path split into fields, or nil to read
+	// attr.command at the top level of each entry.
+	CommandPath []string
+	// UnwrapLogfmt reads each line's entry from the msg field of a logfmt line
+	// written by a log shipper, e.g. ts=... level=info msg="{\"t\": ...}".
+	UnwrapLogfmt bool
+	// SlowOnly restricts JSON log entries to those with msg "Slow query".
+	SlowOnly bool
+	// Since and Until bound the log timestamps of the entries that are
+	// converted; a zero value leaves that side of the window open. Entries
+	// without a parseable timestamp are kept unless RequireTimestamp is set.
+	Since, Until     time.Time
+	RequireTimestamp bool
+	// Ops limits output to the listed operations (registered handler names);
+	// nil selects every supported operation.
+	Ops map[string]bool
+	// NamespaceGlob limits output to namespaces matching this glob (path.Match
+	// syntax, e.g. "shop.*"); empty selects every namespace.
+	NamespaceGlob string
+	// CollectionRegex, when set, limits output to collections whose name it
+	// matches. It is checked separately from -ns, so both must match.
+	CollectionRegex *regexp.Regexp
+	// IncludeInternal keeps commands on the admin, config and local databases.
+	IncludeInternal bool
+	// Limit stops reading input once that many queries have been emitted;
+	// zero means unlimited.
+	Limit int
+	// Strict reports commands l2q has no handler for on stderr.
+	Strict bool
+	// WarnTruncated warns on stderr about legacy lines whose command document
+	// never closes, as when mongod or log rotation cut the line short.
+	WarnTruncated bool
+
+	// Rendering.
+
+	// UpdateStyle selects how update statements are written: "modern" uses
+	// updateOne/updateMany/replaceOne, "legacy" the update(q, u, {multi}) form.
+	UpdateStyle string
+	// Indent is the indent of one nesting level in pretty output.
+	Indent string
+	// InlineArrays is the number of elements above which an array made up
+	// only of scalar values is rendered on a single line even in pretty mode,
+	// so large $in/$nin lists don't take one line per element. Zero disables
+	// it.
+	InlineArrays int
+	// MaxDepth limits how many levels of nested documents and arrays are
+	// rendered; deeper ones are replaced by a /* ... */ placeholder. Zero
+	// means unlimited; defaultConfig sets renderDepthLimit.
+	MaxDepth int
+	// PrettyThreshold, when set, renders a top-level document pretty only
+	// when its compact form is longer than this many characters.
+	PrettyThreshold int
+	// Minify renders every document compact with no spaces at all, as in
+	// {"a":1,"b":2}, and each statement on one line.
+	Minify bool
+	// MaxArrayElements renders only the first this many elements of longer
+	// arrays, followed by a comment counting the rest; zero renders them all.
+	MaxArrayElements int
+	// TruncateStrings shortens rendered string values longer than this many
+	// characters; zero keeps them whole.
+	TruncateStrings int
+	// CollapseRegex renders {$regex, $options} query operators as regex
+	// literals.
+	CollapseRegex bool
+	// ReplaceOIDs renders every ObjectId as oidPlaceholder, so that queries
+	// differing only in the ids they match look the same.
+	ReplaceOIDs bool
+	// PreserveNumberTypes renders $numberInt and $numberDecimal as NumberInt()
+	// and NumberDecimal() rather than bare numbers, for queries whose matching
+	// depends on the BSON type. $numberLong is always NumberLong().
+	PreserveNumberTypes bool
+	// Redact masks the literal values of JSON queries so the output can be
+	// shared without the data it matched. Legacy lines are skipped under it:
+	// their documents are never decoded, so their values can't be told from
+	// structure.
+	Redact bool
+	// DocOnly makes handlers emit only the filter (find, update, mapReduce) or
+	// pipeline (aggregate) document, without the shell call around it or any
+	// comment lines.
+	DocOnly bool
+	// NoExplain leaves .explain() off find and aggregate queries so they can
+	// be replayed; InjectMaxTimeMS then caps each replayed query's server
+	// time.
+	NoExplain       bool
+	InjectMaxTimeMS int
+	// ExplainPrefix writes explain() in front of the find or aggregate call,
+	// db.coll.explain().find(...), instead of after it.
+	ExplainPrefix bool
+
+	// Comments added to each query.
+
+	// Header prefixes each query with a comment naming its namespace,
+	// operation and duration.
+	Header bool
+	// ShowClient names the application that issued each query.
+	ShowClient bool
+	// ShowExecStats prints the execution counters logged with each query.
+	ShowExecStats bool
+	// ShowWinningPlan prints the plan the server logged for a query, so
+	// explain need not be re-run when the log already has the answer.
+	ShowWinningPlan bool
+	// ShowShards prints the shard targeting recorded by mongos for each query.
+	ShowShards bool
+	// ShowQueryHash prints the logged queryHash, planCacheKey and cursor id of
+	// each query, for matching it against $planCacheStats and currentOp.
+	ShowQueryHash bool
+	// Suggest enables heuristic comments pointing at cheaper or safer
+	// alternatives to the reconstructed query.
+	Suggest bool
+	// IndexSuggestion follows each find with an index proposed by the ESR
+	// rule.
+	IndexSuggestion bool
+
+	// Output.
+
+	// Quiet omits the "---" separator after each query.
+	Quiet bool
+	// AppendSemicolons ends every statement with ";" for scripts run with
+	// mongosh --file.
+	AppendSemicolons bool
+	// EvalFormat wraps each statement in printjson() so the output of mongosh
+	// --eval can be captured (-format mongosh-eval).
+	EvalFormat bool
+	// Color highlights keys, operators and shell methods with ANSI escapes.
+	// It is only honoured when stdout is a terminal.
+	Color bool
+	// Validate re-parses every emitted query with shellParser and reports the
+	// ones that don't parse on stderr. Nothing is executed.
+	Validate bool
+	// Script buffers queries per database and prints them as a mongosh script
+	// with one "use <db>" per database and bare db.<coll> accessors.
+	Script bool
+	// GroupByNS buffers every query until input is exhausted so they can be
+	// printed grouped by namespace rather than in log order.
+	GroupByNS bool
+	// SortByDuration buffers every query with the duration of its log entry
+	// and prints the slowest first; Limit then picks the slowest N.
+	SortByDuration bool
+	// EmitGetIndexes precedes the first query on each namespace with a
+	// getIndexes() call, so the indexes the queries could use are one paste
+	// away.
+	EmitGetIndexes bool
+	// SplitDir, when set, sends each namespace's queries to its own file in
+	// that directory instead of stdout. The files are the groups GroupByNS
+	// would print; Script, which is laid out by database, can't be combined
+	// with it.
+	SplitDir string
+	// CountOnly suppresses query output in favour of a per-namespace
+	// operation tally printed once all input has been read.
+	CountOnly bool
+	// FieldUsage counts, per namespace, the combinations of fields that JSON
+	// queries filter on, as input for choosing compound indexes.
+	FieldUsage bool
+}
+
+// defaultConfig returns the options l2q runs with when no flag is given.
+func defaultConfig() Config {
+	return Config{InputFormat: "auto", UpdateStyle: "modern", Indent: "  ", InlineArrays: 10, MaxDepth: renderDepthLimit}
+}
+
+// config is the Config in effect.
+var config = defaultConfig()
+
+// groupedQueries is the -group-by-ns buffer, by namespace.
+var groupedQueries = map[string][]string{}
+
+// indexedNamespaces records the namespaces -emit-getindexes has covered.
+var indexedNamespaces = map[string]bool{}
+
+// timedQueries is the -sort-by buffer.
+var timedQueries []timedQuery
+
+type timedQuery struct {
+	database, collection, query string
+	ms                          int64
+	hasDuration                 bool
+}
+
+// entryDuration is the duration of the log entry being converted, recorded
+// with each query buffered for -sort-by.
+var entryDuration struct {
+	ms int64
+	ok bool
+}
+
+// explainVerbosity is the verbosity of the explain the log entry being
+// converted wraps its command in, passed on to .explain().
+var explainVerbosity string
+
+type scriptEntry struct{ collection, query string }
+
+var scriptQueries = map[string][]scriptEntry{}
+
+type opCount struct{ ns, op string }
+
+var operationCounts = map[opCount]int{}
+
+// shapeTarget, when set, receives the shape of every query instead of the
+// query being printed. -diff uses it to collect the shapes in each file.
+var shapeTarget *shapeSet
+
+// shapeSet holds distinct query shapes in the order they were first seen.
+type shapeSet struct {
+	shapes []string
+	where  map[string]opCount
+}
+
+func newShapeSet() *shapeSet { return &shapeSet{where: map[string]opCount{}} }
+
+func (s *shapeSet) add(at opCount, shape string) {
+	if _, ok := s.where[shape]; ok { return }
+	s.where[shape] = at
+	s.shapes = append(s.shapes, shape)
+}
+
+// subcommands maps the first argument to the mode it selects. Bare
+// invocation (no subcommand) runs convert, so existing pipelines keep working;
+// a log file that happens to be named like a subcommand needs a ./ prefix.
+var subcommands = map[string]func(args []string) int{
+	"convert": runConvert,
+	"stats":   runStats,
+	"diff":    runDiffCommand,
+	"shapes":  runShapes,
+	"check":   runCheck,
+}
+
 func main() {
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
+	name, args := "convert", os.Args[1:]
+	if len(args) > 0 {
+		if _, ok := subcommands[args[0]]; ok { name, args = args[0], args[1:] }
+	}
+	status := subcommands[name](args)
+	if outputFile != nil {
+		if err := outputFile.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", outputFile.Name(), err)
+			if status == 0 { status = 2 }
+		}
+	}
+	os.Exit(status)
+}
+
+// output receives everything l2q prints that isn't diagnostics: stdout, or
+// the -o file, which main closes once the subcommand returns. -split-dir
+// files are opened per namespace on top of it.
+var output io.Writer = os.Stdout
+var outputFile *os.File
+
+// passThrough, set by -tee, receives every input line unchanged as it is
+// read, while the queries go to output. Input is then read to the end even
+// after -limit is reached, so that nothing downstream is cut off.
+var passThrough io.Writer
+
+// inputFlags holds the selection and rendering flags every subcommand
+// accepts, so that stats, diff and shapes see the same queries convert prints.
+type inputFlags struct {
+	since, until, op, output, commandPath, collectionRegex *string
+	appendOutput                                          *bool
+}
+
+func addInputFlags(fs *flag.FlagSet) *inputFlags {
+	f := &inputFlags{}
+	fs.BoolVar(&config.SlowOnly, "slow-only", false, "only convert JSON log entries whose msg is \"Slow query\"")
+	fs.BoolVar(&config.UnwrapLogfmt, "unwrap-logfmt", false, "read each entry from the quoted msg=\"...\" field of logfmt lines")
+	f.commandPath = fs.String("command-json-path", "", "dot path of the command in wrapped JSON entries, e.g. message.attr.command (default attr.command)")
+	fs.StringVar(&config.InputFormat, "input-format", config.InputFormat, "log format: auto (detect per line), json or legacy")
+	fs.BoolVar(&config.MultilineJSON, "multiline-json", false, "read JSON entries regardless of line breaks, for pretty-printed logs (no legacy lines)")
+	fs.BoolVar(&config.IncludeInternal, "include-internal", false, "keep commands on the admin, config and local databases")
+	fs.StringVar(&config.NamespaceGlob, "ns", "", "only convert queries on namespaces matching this glob, e.g. shop.* (collections read by $lookup/$unionWith count)")
+	f.collectionRegex = fs.String("collection-regex", "", "only convert queries on collections whose name matches this regular expression, e.g. ^events_2024_")
+	f.output = fs.String("o", "", "write output to this file instead of stdout")
+	f.appendOutput = fs.Bool("append", false, "with -o, append to the file instead of truncating it")
+	f.op = fs.String("op", "", "comma-separated operations to convert, e.g. find,aggregate (default all)")
+	fs.IntVar(&config.Limit, "limit", 0, "stop after emitting N queries (0 is unlimited)")
+	fs.BoolVar(&config.WarnTruncated, "warn-truncated", false, "warn on stderr about legacy lines whose command document is cut off or unbalanced")
+	fs.BoolVar(&config.Strict, "strict", false, "warn on stderr about logged commands that can't be converted")
+	fs.StringVar(&config.UpdateStyle, "update-style", config.UpdateStyle, "method names for updates: modern (updateOne/updateMany) or legacy (update)")
+	fs.IntVar(&config.MaxDepth, "max-depth", config.MaxDepth, "replace documents nested deeper than N levels with a placeholder (0 means unlimited)")
+	fs.IntVar(&config.TruncateStrings, "truncate-strings", config.TruncateStrings, "shorten string values longer than N characters, noting their length (0 keeps them whole)")
+	fs.IntVar(&config.PrettyThreshold, "pretty-threshold", config.PrettyThreshold, "render documents compact unless their compact form is longer than N characters (0 is always pretty)")
+	fs.BoolVar(&config.Minify, "minify", false, "render each statement on one line, its documents without any spaces, e.g. {\"a\":1,\"b\":2}")
+	fs.BoolVar(&config.ReplaceOIDs, "replace-oids", false, "render every ObjectId as ObjectId(\"<id>\") so queries differing only in ids compare equal")
+	fs.BoolVar(&config.PreserveNumberTypes, "preserve-number-types", false, "render $numberInt and $numberDecimal as NumberInt() and NumberDecimal() instead of bare numbers")
+	fs.IntVar(&config.MaxArrayElements, "max-array-elements", config.MaxArrayElements, "render only the first N elements of longer arrays, noting how many were left out (0 renders them all)")
+	fs.BoolVar(&config.Redact, "redact", false, "mask string and number values in JSON queries as <string>/<number>, keeping their shape (legacy lines are skipped)")
+	fs.BoolVar(&config.CollapseRegex, "collapse-regex", false, "render {$regex, $options} operators as /pattern/options literals")
+	fs.IntVar(&config.InlineArrays, "inline-arrays", config.InlineArrays, "render arrays of more than N scalar values on one line in pretty output (0 disables)")
+	f.since = fs.String("since", "", "only convert entries logged at or after this RFC3339 time")
+	f.until = fs.String("until", "", "only convert entries logged at or before this RFC3339 time")
+	fs.BoolVar(&config.RequireTimestamp, "require-timestamp", false, "with -since/-until, skip entries whose timestamp can't be parsed")
+	return f
+}
+
+// apply validates the parsed flags and sets the package state they control,
+// exiting with status 2 on an invalid value.
+func (f *inputFlags) apply() {
+	config.Ops = parseOpFlag(*f.op)
+	if *f.commandPath != "" { config.CommandPath = strings.Split(*f.commandPath, ".") }
+	if err := config.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *f.collectionRegex != "" {
+		re, err := regexp.Compile(*f.collectionRegex)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -collection-regex %q: %v\n", *f.collectionRegex, err)
+			os.Exit(2)
+		}
+		config.CollectionRegex = re
+	}
+	config.Since = parseTimeFlag("since", *f.since)
+	config.Until = parseTimeFlag("until", *f.until)
+	if *f.output != "" { openOutput("-o", *f.output, *f.appendOutput) }
+}
+
+// validate reports the first option of c holding a value a conversion can't
+// use, naming the flag that sets it.
+func (c Config) validate() error {
+	if c.UpdateStyle != "modern" && c.UpdateStyle != "legacy" { return fmt.Errorf("invalid -update-style value %q: want modern or legacy", c.UpdateStyle) }
+	if c.InputFormat != "auto" && c.InputFormat != "json" && c.InputFormat != "legacy" {
+		return fmt.Errorf("invalid -input-format value %q: want auto, json or legacy", c.InputFormat)
+	}
+	if c.CommandPath != nil {
+		joined := strings.Join(c.CommandPath, ".")
+		if len(c.CommandPath) < 2 || strings.Contains("."+joined+".", "..") {
+			return fmt.Errorf("invalid -command-json-path %q: want a dot path ending in the attr and command fields, e.g. message.attr.command", joined)
+		}
+	}
+	if c.MaxDepth < 0 { return fmt.Errorf("invalid -max-depth %d: want 0 for unlimited or a positive depth", c.MaxDepth) }
+	if c.Script && c.SplitDir != "" { return fmt.Errorf("-script and -split-dir can't be combined: a script is laid out by database, not by namespace") }
+	if _, err := path.Match(c.NamespaceGlob, ""); err != nil { return fmt.Errorf("invalid -ns pattern %q: %v", c.NamespaceGlob, err) }
+	for op := range c.Ops {
+		if _, ok := commandHandlers[op]; !ok { return fmt.Errorf("invalid -op value %q: unsupported operation", op) }
+	}
+	return nil
+}
+
+// openOutput makes the file named by flag the output, exiting with status 2
+// if it can't be opened.
+func openOutput(flag, name string, appendOutput bool) {
+	mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendOutput { mode = os.O_WRONLY | os.O_CREATE | os.O_APPEND }
+	file, err := os.OpenFile(name, mode, 0o644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening %s file: %v\n", flag, err)
+		os.Exit(2)
+	}
+	output, outputFile = file, file
+}
+
+// readInputs processes the files named in args, or stdin when there are none,
+// and reports whether any of them could not be read.
+func readInputs(args []string) (readFailed bool) {
+	if len(args) == 0 {
+		if err := processInput("", os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading from stdin: %v\n", err)
+			readFailed = true
+		}
+		return readFailed
+	}
+	for _, path := range args {
+		if limitReached() && passThrough == nil { break }
+		if err := processFile(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", path, err)
+			readFailed = true
+		}
+	}
+	return readFailed
+}
+
+// exitStatus is 2 when input could not be read, 1 when nothing was
+// reconstructed, 0 when at least one query was produced.
+func exitStatus(readFailed bool) int {
+	if readFailed { return 2 }
+	if stats.queries == 0 { return 1 }
+	return 0
+}
+
+func runConvert(args []string) int {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	showStats := fs.Bool("stats", false, "write a summary of the run to stderr")
+	tee := fs.String("tee", "", "write queries to this file and copy every input line unchanged to stdout")
+	follow := fs.Bool("follow", false, "keep reading the log file as it grows, like tail -f, until interrupted")
+	diffMode := fs.Bool("diff", false, "given two log files, print the query shapes that appear only in the second")
+	fs.BoolVar(&config.CountOnly, "count-only", false, "print a table of operation counts per namespace instead of queries")
+	fs.BoolVar(&config.Script, "script", false, "print a mongosh script with a use <db> line per database instead of getSiblingDB() prefixes")
+	fs.BoolVar(&config.GroupByNS, "group-by-ns", false, "buffer output and print queries grouped by database.collection")
+	sortBy := fs.String("sort-by", "", "buffer output and print queries in this order: duration (slowest first)")
+	fs.BoolVar(&config.EmitGetIndexes, "emit-getindexes", false, "print a getIndexes() call before the first query on each namespace")
+	fs.BoolVar(&config.Suggest, "suggest", false, "add comments suggesting cheaper equivalents for recognised query patterns")
+	fs.BoolVar(&config.FieldUsage, "field-usage", false, "write a report of the filter field combinations queried on each namespace to stderr")
+	fs.BoolVar(&config.IndexSuggestion, "index-suggestion", false, "print a suggested createIndex() following the ESR rule after each find")
+	fs.BoolVar(&config.Color, "color", false, "syntax-highlight output when writing to a terminal")
+	fs.BoolVar(&config.ShowExecStats, "show-exec-stats", false, "print keys/docs examined, documents returned and response size as a comment")
+	fs.BoolVar(&config.ShowWinningPlan, "show-winning-plan", false, "print the logged execution plan (stages and indexes) as a comment")
+	fs.BoolVar(&config.ShowShards, "show-shards", false, "print the shards a mongos query was routed to as a comment")
+	fs.BoolVar(&config.ShowQueryHash, "show-query-hash", false, "print the logged queryHash, planCacheKey and cursorid as a comment")
+	fs.BoolVar(&config.AppendSemicolons, "append-semicolons", false, "end each emitted statement with a semicolon")
+	fs.BoolVar(&config.Quiet, "quiet", false, "omit the \"---\" separator after each query")
+	fs.BoolVar(&config.Header, "header", false, "precede each query with a // db.coll op (duration) comment")
+	fs.BoolVar(&config.ShowClient, "show-client", false, "print the application name that issued each query as a comment")
+	fs.StringVar(&config.SplitDir, "split-dir", "", "write each namespace's queries to its own file in this directory instead of stdout")
+	fs.BoolVar(&config.NoExplain, "no-explain", false, "emit runnable find and aggregate queries without .explain()")
+	explainStyle := fs.String("explain-style", "suffix", "where find and aggregate queries call explain(): suffix (db.coll.find(...).explain()) or prefix (db.coll.explain().find(...))")
+	fs.IntVar(&config.InjectMaxTimeMS, "inject-max-time-ms", 0, "with -no-explain, cap every find and aggregate at N ms, overriding any logged maxTimeMS")
+	fs.BoolVar(&config.DocOnly, "doc-only", false, "print only the filter or pipeline document of each query")
+	fs.BoolVar(&config.Validate, "validate", false, "re-parse each generated query and report on stderr any that isn't well-formed shell syntax")
+	format := fs.String("format", "shell", "output format: shell, mongosh-eval to wrap each statement in printjson() (with -quiet the output is one --eval script), or compass-pipeline for the bare pipeline or filter to paste into Compass")
+	indentFlag := fs.String("indent", "2", "indent pretty output by tab or by this many spaces per level")
+	input := addInputFlags(fs)
+	fs.Parse(args)
+	input.apply()
+	if *tee != "" {
+		if outputFile != nil {
+			fmt.Fprintln(os.Stderr, "-tee and -o both name the query output; give one of them")
+			return 2
+		}
+		openOutput("-tee", *tee, *input.appendOutput)
+		passThrough = os.Stdout
+	}
+	config.Indent = parseIndentFlag(*indentFlag)
+	switch *format {
+	case "shell":
+	case "mongosh-eval":
+		config.EvalFormat = true
+	case "compass-pipeline":
+		// What Compass takes is what -doc-only prints, always pretty: the
+		// pipeline of an aggregate, the filter of anything else.
+		config.DocOnly, config.PrettyThreshold = true, 0
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -format value %q: want shell, mongosh-eval or compass-pipeline\n", *format)
+		return 2
+	}
+	switch *explainStyle {
+	case "suffix":
+	case "prefix":
+		config.ExplainPrefix = true
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -explain-style value %q: want suffix or prefix\n", *explainStyle)
+		return 2
+	}
+	switch *sortBy {
+	case "":
+	case "duration":
+		config.SortByDuration = true
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -sort-by value %q: want duration\n", *sortBy)
+		return 2
+	}
+	if config.Color && (outputFile != nil || !isTerminal(os.Stdout)) { config.Color = false }
+	if config.SplitDir != "" {
+		if err := os.MkdirAll(config.SplitDir, 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating -split-dir: %v\n", err)
+			return 2
+		}
+	}
+
+	// -diff predates the diff subcommand and is kept for existing scripts.
+	if *diffMode { return diffFiles(fs.Args()) }
+
+	readFailed := false
+	if *follow {
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "-follow takes exactly one log file")
+			return 2
+		}
+		if err := followFile(fs.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", fs.Arg(0), err)
+			readFailed = true
+		}
+	} else {
+		readFailed = readInputs(fs.Args())
+	}
+	flushOutput()
+	if *showStats { printStats(os.Stderr) }
+	return exitStatus(readFailed)
+}
+
+// convert converts the log read from r as the convert subcommand does with
+// the options in cfg, writing the queries to w; the -field-usage report goes
+// to stderr. The tests drive conversions through it. All package state is
+// reset first, and since it is package state, conversions must not run
+// concurrently. A SplitDir must already exist.
+func convert(cfg Config, r io.Reader, w io.Writer) error {
+	if err := cfg.validate(); err != nil { return err }
+	config, output = cfg, w
+	resetState()
+	err := processInput("", r)
+	flushOutput()
+	return err
+}
+
+// resetState empties the buffers, counters and per-entry state a conversion
+// fills and drops the -tee and shape collection targets.
+func resetState() {
+	stats.lines, stats.json, stats.legacy, stats.queries, stats.parsed, stats.unparsed = 0, 0, 0, 0, 0, 0
+	stats.operations = map[string]int{}
+	stats.durations = make([]int, len(durationBuckets)+1)
+	groupedQueries = map[string][]string{}
+	indexedNamespaces = map[string]bool{}
+	timedQueries = nil
+	scriptQueries = map[string][]scriptEntry{}
+	operationCounts = map[opCount]int{}
+	splitFiles = map[string]*os.File{}
+	fieldCombinations = map[string]map[string]int{}
+	shapeTarget, passThrough = nil, nil
+	position.name, position.line = "", 0
+	entryDuration.ms, entryDuration.ok = 0, false
+	explainVerbosity, depthWarned = "", false
+}
+
+// flushOutput prints what the buffering modes held back until the input was
+// exhausted and closes the -split-dir files.
+func flushOutput() {
+	if config.SortByDuration { deliverByDuration() }
+	if config.Script {
+		printScript()
+	} else if config.GroupByNS {
+		printGroups()
+	}
+	if config.CountOnly { printCounts() }
+	if config.SplitDir != "" { closeSplitFiles() }
+	if config.FieldUsage { printFieldUsage(os.Stderr) }
+}
+
+// runStats reads the input without printing queries and writes the run
+// summary to stdout.
+func runStats(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	input := addInputFlags(fs)
+	fs.Parse(args)
+	input.apply()
+	shapeTarget = newShapeSet() // collects and discards the queries
+	readFailed := readInputs(fs.Args())
+	printStats(output)
+	return exitStatus(readFailed)
+}
+
+func runDiffCommand(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	input := addInputFlags(fs)
+	fs.Parse(args)
+	input.apply()
+	return diffFiles(fs.Args())
+}
+
+func diffFiles(paths []string) int {
+	if len(paths) != 2 {
+		fmt.Fprintln(os.Stderr, "diff takes exactly two log files")
+		return 2
+	}
+	return runDiff(paths[0], paths[1])
+}
+
+// runShapes prints each distinct query shape once, in the order first seen,
+// with the namespace and operation it was first seen on.
+func runShapes(args []string) int {
+	fs := flag.NewFlagSet("shapes", flag.ExitOnError)
+	input := addInputFlags(fs)
+	fs.Parse(args)
+	input.apply()
+	shapes := newShapeSet()
+	shapeTarget = shapes
+	readFailed := readInputs(fs.Args())
+	shapeTarget = nil
+	for _, shape := range shapes.shapes {
+		at := shapes.where[shape]
+		printQuery(fmt.Sprintf("// %s (%s)\n%s", at.ns, at.op, shape))
+	}
+	return exitStatus(readFailed)
+}
+
+// runCheck reads the input without printing queries and reports on stderr how
+// many log entries parsed, i.e. yielded a namespace and a command. It is meant
+// as a CI guard against log format changes: the status is 1 when the share of
+// entries that failed to parse exceeds -fail-threshold (or nothing parsed at
+// all) and 2 when input could not be read.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	threshold := fs.Float64("fail-threshold", 0, "largest tolerated fraction of entries that fail to parse, from 0 to 1")
+	input := addInputFlags(fs)
+	fs.Parse(args)
+	input.apply()
+	if *threshold < 0 || *threshold > 1 {
+		fmt.Fprintf(os.Stderr, "invalid -fail-threshold %v: want a fraction from 0 to 1\n", *threshold)
+		return 2
+	}
+	shapeTarget = newShapeSet() // collects and discards the queries
+	readFailed := readInputs(fs.Args())
+	total := stats.parsed + stats.unparsed
+	ratio := 0.0
+	if total > 0 { ratio = float64(stats.unparsed) / float64(total) }
+	fmt.Fprintf(os.Stderr, "parsed: %d\nfailed: %d (%.1f%%)\n", stats.parsed, stats.unparsed, ratio*100)
+	switch {
+	case readFailed:
+		return 2
+	case stats.parsed == 0 || ratio > *threshold:
+		return 1
+	}
+	return 0
+}
+
+func parseTimeFlag(name, value string) time.Time {
+	if value == "" { return time.Time{} }
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -%s value: %v\n", name, err)
+		os.Exit(2)
+	}
+	return t
+}
+
+// inTimeWindow reports whether an entry logged at t (ok is false when its
+// timestamp couldn't be parsed) falls inside the -since/-until window.
+func inTimeWindow(t time.Time, ok bool) bool {
+	if config.Since.IsZero() && config.Until.IsZero() { return true }
+	if !ok { return !config.RequireTimestamp }
+	if !config.Since.IsZero() && t.Before(config.Since) { return false }
+	if !config.Until.IsZero() && t.After(config.Until) { return false }
+	return true
+}
+
+// runDiff prints the query shapes found in newPath but not in oldPath, such
+// as slow queries that started appearing after a deploy, and returns the
+// process exit status.
+func runDiff(oldPath, newPath string) int {
+	sets := make([]*shapeSet, 2)
+	for i, path := range []string{oldPath, newPath} {
+		sets[i] = newShapeSet()
+		shapeTarget = sets[i]
+		if err := processFile(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", path, err)
+			return 2
+		}
+	}
+	shapeTarget = nil
+
+	found := 0
+	for _, shape := range sets[1].shapes {
+		if _, ok := sets[0].where[shape]; ok { continue }
+		at := sets[1].where[shape]
+		printQuery(fmt.Sprintf("// new shape on %s (%s)\n%s", at.ns, at.op, shape))
+		found++
+	}
+	if found == 0 { return 1 }
+	return 0
+}
+
+func processFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil { return err }
+	position.name, position.line = path, 0
+	defer f.Close()
+	return processInput(path, f)
+}
+
+// processInput scans r line by line. Gzip-compressed input (rotated
+// mongod.log.gz files) is detected by name or by its magic bytes and
+// decompressed on the fly.
+func processInput(name string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	if strings.HasSuffix(name, ".gz") || (len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b) {
+		gz, err := gzip.NewReader(br)
+		if err != nil { return err }
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	// Atlas exports logs as a single JSON array rather than one entry per line.
+	ar := bufio.NewReader(r)
+	if bom, _ := ar.Peek(len(utf8BOM)); bytes.Equal(bom, utf8BOM) {
+		ar.Discard(len(utf8BOM))
+		if passThrough != nil { passThrough.Write(utf8BOM) }
+	}
+	// Entries not split into lines are passed through as they are read.
+	var entries io.Reader = ar
+	if passThrough != nil { entries = io.TeeReader(ar, passThrough) }
+	if config.InputFormat != "legacy" && startsWithArray(ar) { return passRest(entries, processArray(entries)) }
+	if config.MultilineJSON { return passRest(entries, processStream(entries)) }
+	scanner := bufio.NewScanner(ar)
+	if passThrough != nil { scanner.Split(teeLines) }
+	position.name, position.line = name, 0
+	if name == "" { position.name = "stdin" }
+	for (passThrough != nil || !limitReached()) && scanner.Scan() {
+		stats.lines++
+		position.line++
 		processLine(scanner.Bytes())
 	}
+	return scanner.Err()
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// passRest passes on whatever of r is left once reading stopped at -limit
+// or an error, and returns err.
+func passRest(r io.Reader, err error) error {
+	if passThrough != nil { io.Copy(io.Discard, r) }
+	return err
+}
+
+// teeLines splits input like bufio.ScanLines and copies each line, with its
+// line ending, to passThrough as it is scanned.
+func teeLines(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	if advance > 0 { passThrough.Write(data[:advance]) }
+	return advance, token, err
+}
+
+// position is the input and line number being processed, for warnings.
+var position struct {
+	name string
+	line int
+}
+
+// startsWithArray reports whether the first non-whitespace byte is '[',
+// without consuming any input.
+func startsWithArray(br *bufio.Reader) bool {
+	for n := 1; ; n++ {
+		peeked, err := br.Peek(n)
+		if err != nil { return false }
+		switch peeked[n-1] {
+		case ' ', '\t', '\r', '\n':
+		default:
+			return peeked[n-1] == '['
+		}
+	}
+}
+
+// processArray decodes a JSON array of log entries, counting each element as
+// an input line.
+func processArray(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if _, err := decoder.Token(); err != nil { return err }
+	for decoder.More() {
+		if limitReached() { return nil }
+		logEntry, err := decodeDocument(decoder)
+		if err != nil { return err }
+		stats.lines++
+		processEntry(logEntry)
+	}
+	_, err := decoder.Token()
+	return err
+}
+
+// processStream decodes consecutive JSON log entries however they are split
+// across lines, counting each entry as an input line. Decoding stops at the
+// first malformed entry, since there is no line boundary to resume from.
+func processStream(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	for !limitReached() {
+		logEntry, err := decodeDocument(decoder)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			stats.unparsed++
+			return err
+		}
+		stats.lines++
+		processEntry(logEntry)
+	}
+	return nil
+}
+
+// parseOpFlag turns the -op list into a set of handler names, exiting on an
+// operation l2q can't convert.
+func parseOpFlag(value string) map[string]bool {
+	if value == "" { return nil }
+	ops := map[string]bool{}
+	for _, op := range strings.Split(value, ",") {
+		op = strings.TrimSpace(op)
+		if op == "" { continue }
+		name, ok := handlerName(op)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "invalid -op value %q: unsupported operation\n", op)
+			os.Exit(2)
+		}
+		ops[name] = true
+	}
+	return ops
+}
+
+// followPollInterval is how often -follow checks the file for new data.
+const followPollInterval = 250 * time.Millisecond
+
+// followFile behaves like tail -f: it processes the file's contents and then
+// each line appended to it, reopening the file from the start when it is
+// truncated or replaced by log rotation. It returns cleanly on SIGINT.
+func followFile(path string) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	f, err := os.Open(path)
+	if err != nil { return err }
+	defer func() { f.Close() }()
+	position.name, position.line = path, 0
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	var pending []byte
+	for passThrough != nil || !limitReached() {
+		chunk, err := reader.ReadBytes('\n')
+		offset += int64(len(chunk))
+		pending = append(pending, chunk...)
+		if err == nil {
+			if passThrough != nil { passThrough.Write(pending) }
+			stats.lines++
+			position.line++
+			processLine(bytes.TrimSuffix(pending, []byte("\n")))
+			pending = pending[:0]
+			continue
+		}
+		if err != io.EOF { return err }
+
+		select {
+		case <-interrupt:
+			return nil
+		case <-time.After(followPollInterval):
+		}
+
+		// A rotated file is replaced by a new one at the same path; a
+		// truncated one shrinks below what was already read.
+		latest, err := os.Stat(path)
+		if err != nil { continue } // rotated away and not yet recreated
+		current, err := f.Stat()
+		if err == nil && os.SameFile(latest, current) && latest.Size() >= offset { continue }
+		f.Close()
+		if f, err = os.Open(path); err != nil { return err }
+		reader.Reset(f)
+		offset = 0
+		position.name, position.line = path, 0
+		pending = pending[:0]
+	}
+	return nil
+}
+
+// processLine handles one input line. A line may hold several JSON log entries
+// (some proxies batch them), so documents are decoded until the line is
+// exhausted; the legacy text parser is only used when none decodes at all.
+func processLine(line []byte) {
+	// Logs from Windows tooling end lines in CRLF and may start with a BOM.
+	line = bytes.TrimPrefix(bytes.TrimSuffix(line, []byte("\r")), utf8BOM)
+	if len(bytes.TrimSpace(line)) == 0 { return }
+	if config.UnwrapLogfmt {
+		if payload, ok := logfmtMessage(line); ok { line = payload }
+	}
+	if config.InputFormat == "legacy" {
+		stats.legacy++
+		processLineLegacy(line)
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+
+	decoded := false
+	for !limitReached() {
+		logEntry, err := decodeDocument(decoder)
+		if err != nil { break }
+		decoded = true
+		processEntry(logEntry)
+	}
+	// A line that opens like JSON but doesn't decode is a damaged entry.
+	if !decoded && bytes.HasPrefix(bytes.TrimSpace(line), []byte("{")) { stats.unparsed++ }
+	if decoded || config.InputFormat == "json" { return }
+	stats.legacy++
+	processLineLegacy(line)
+}
+
+// logfmtMessage returns the unquoted value of a logfmt line's msg field. A
+// line without one is left to the other parsers.
+func logfmtMessage(line []byte) ([]byte, bool) {
+	i := 0
+	for from := 0; ; from = i + 1 {
+		j := bytes.Index(line[from:], []byte("msg="))
+		if j == -1 { return nil, false }
+		i = from + j
+		if i == 0 || line[i-1] == ' ' || line[i-1] == '\t' { break } // not e.g. submsg=
+	}
+	value := line[i+len("msg="):]
+	if len(value) == 0 || value[0] != '"' {
+		if end := bytes.IndexAny(value, " \t"); end != -1 { value = value[:end] }
+		return value, true
+	}
+	end := 1
+	for end < len(value) && value[end] != '"' {
+		if value[end] == '\\' { end++ }
+		end++
+	}
+	if end >= len(value) { return nil, false }
+	unquoted, err := strconv.Unquote(string(value[:end+1]))
+	if err != nil { return nil, false }
+	return []byte(unquoted), true
+}
+
+// processEntry dispatches a decoded JSON document, either a structured log
+// entry or a profiler document; anything else is ignored. -slow-only applies
+// to log entries only, since every profiler document is a profiled operation.
+func processEntry(logEntry map[string]interface{}) {
+	if config.CommandPath != nil {
+		unwrapped, ok := unwrapEntry(logEntry)
+		if !ok { return }
+		logEntry = unwrapped
+	}
+	logEntry = withAttr(logEntry)
+	if _, ok := logEntry["attr"]; ok {
+		stats.json++
+		if config.SlowOnly && logEntry["msg"] != "Slow query" { return }
+		processLineJSON(logEntry)
+	} else if isProfilerDocument(logEntry) {
+		stats.json++
+		processLineJSON(fromProfilerDocument(logEntry))
+	}
+}
+
+// unwrapEntry finds the log entry in a document wrapped by a log pipeline,
+// following -command-json-path: the fields before the last two lead to the
+// entry, the next names its attr document and the last the command under
+// it. Fields holding a stringified document, as Kubernetes' "log" field
+// does, are decoded on the way.
+func unwrapEntry(doc map[string]interface{}) (map[string]interface{}, bool) {
+	n := len(config.CommandPath)
+	entry := doc
+	for _, field := range config.CommandPath[:n-2] {
+		next, ok := commandDocument(entry[field])
+		if !ok { return nil, false }
+		entry = next
+	}
+	attr, ok := commandDocument(entry[config.CommandPath[n-2]])
+	if !ok { return nil, false }
+	command, ok := attr[config.CommandPath[n-1]]
+	if !ok { return nil, false }
+
+	unwrappedAttr := make(map[string]interface{}, len(attr)+1)
+	for k, v := range attr { unwrappedAttr[k] = v }
+	unwrappedAttr["command"] = command
+	unwrapped := make(map[string]interface{}, len(entry)+1)
+	for k, v := range entry { unwrapped[k] = v }
+	unwrapped["attr"] = unwrappedAttr
+	return unwrapped, true
+}
+
+// withAttr renames the "attributes" field some log processors use for attr,
+// so such entries take the same path as mongod's own.
+func withAttr(logEntry map[string]interface{}) map[string]interface{} {
+	if _, ok := logEntry["attr"]; ok { return logEntry }
+	attributes, ok := logEntry["attributes"]
+	if !ok { return logEntry }
+	renamed := make(map[string]interface{}, len(logEntry))
+	for k, v := range logEntry { renamed[k] = v }
+	delete(renamed, "attributes")
+	renamed["attr"] = attributes
+	return renamed
+}
+
+// isProfilerDocument recognises documents exported from db.system.profile,
+// which have op and ns at the top level instead of an attr wrapper.
+func isProfilerDocument(doc map[string]interface{}) bool {
+	_, hasOp := doc["op"].(string)
+	_, hasNS := doc["ns"].(string)
+	return hasOp && hasNS
+}
+
+// fromProfilerDocument reshapes a profiler document into a log entry. The
+// profiler's ns and command fields match the names used under attr, and its
+// "ts" timestamp stands in for the log's "t".
+func fromProfilerDocument(doc map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"t": doc["ts"], "attr": doc}
+}
+
+// emit writes a reconstructed query followed by the separator line, or
+// buffers it under its namespace when grouping.
+func emit(op, database, collection, query string) {
+	if limitReached() { return } // a handler may produce several queries
+	stats.queries++
+	stats.operations[op]++
+	ns := database + "." + collection
+	if config.Validate {
+		if err := validateQuery(query); err != nil { fmt.Fprintf(os.Stderr, "validate: %s %s query does not parse: %v\n%s\n", ns, op, err, query) }
+	}
+	if config.EvalFormat { query = printjsonStatement(query) }
+	if config.AppendSemicolons { query = terminateStatement(query) }
+	if shapeTarget != nil {
+		shapeTarget.add(opCount{ns, op}, queryShape(query))
+		return
+	}
+	if config.CountOnly {
+		operationCounts[opCount{ns, op}]++
+		return
+	}
+	if config.SortByDuration {
+		timedQueries = append(timedQueries, timedQuery{database, collection, query, entryDuration.ms, entryDuration.ok})
+		return
+	}
+	deliver(database, collection, query)
+}
+
+// deliver hands a finished query to the output mode in use.
+func deliver(database, collection, query string) {
+	ns := database + "." + collection
+	if config.EmitGetIndexes && !indexedNamespaces[ns] {
+		indexedNamespaces[ns] = true
+		statement := collectionRef(database, collection) + ".getIndexes()"
+		if config.EvalFormat { statement = printjsonStatement(statement) }
+		if config.AppendSemicolons { statement += ";" }
+		deliver(database, collection, statement)
+	}
+	if config.Script {
+		scriptQueries[database] = append(scriptQueries[database], scriptEntry{collection, query})
+		return
+	}
+	if config.SplitDir != "" {
+		writeSplit(ns, query)
+		return
+	}
+	if config.GroupByNS {
+		groupedQueries[ns] = append(groupedQueries[ns], query)
+		return
+	}
+	printQuery(query)
+}
+
+// printjsonStatement wraps the statement of a query in printjson() for
+// mongosh --eval. Comment lines before and after the statement stay outside
+// the call.
+func printjsonStatement(query string) string {
+	lines := strings.Split(query, "\n")
+	first, last := -1, -1
+	for i, line := range lines {
+		if strings.HasPrefix(line, "//") { continue }
+		if first == -1 { first = i }
+		last = i
+	}
+	if first == -1 { return query }
+	lines[first] = "printjson(" + lines[first]
+	lines[last] += ")"
+	return strings.Join(lines, "\n")
+}
+
+// terminateStatement ends the query's statement with a semicolon. Comment
+// lines may follow the statement, so the semicolon goes on its last line.
+func terminateStatement(query string) string {
+	lines := strings.Split(query, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if !strings.HasPrefix(lines[i], "//") {
+			lines[i] += ";"
+			break
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// queryHeader renders the -header comment; the duration is left out when the
+// entry has none.
+func queryHeader(database, collection, op string, ms int64, hasDuration bool) string {
+	if !hasDuration { return fmt.Sprintf("// %s.%s %s\n", database, collection, op) }
+	return fmt.Sprintf("// %s.%s %s (%dms)\n", database, collection, op, ms)
+}
+
+// limitReached reports whether -limit queries have been emitted. When sorting
+// by duration the whole input is read and the limit applies to the sorted
+// queries instead.
+func limitReached() bool { return config.Limit > 0 && !config.SortByDuration && stats.queries >= config.Limit }
+
+// deliverByDuration sorts the buffered queries slowest first, those without
+// a duration last, and delivers up to -limit of them. The sort is stable, so
+// equally slow queries stay in log order.
+func deliverByDuration() {
+	sort.SliceStable(timedQueries, func(i, j int) bool {
+		a, b := timedQueries[i], timedQueries[j]
+		if a.hasDuration != b.hasDuration { return a.hasDuration }
+		return a.ms > b.ms
+	})
+	for i, q := range timedQueries {
+		if config.Limit > 0 && i >= config.Limit { break }
+		deliver(q.database, q.collection, q.query)
+	}
+}
+
+func printQuery(query string) {
+	if config.Color { query = colorize(query) }
+	writeQuery(output, query)
+}
+
+// writeQuery writes a query followed by the divider between queries, which
+// -quiet leaves out.
+func writeQuery(w io.Writer, query string) {
+	fmt.Fprintln(w, query)
+	if !config.Quiet { fmt.Fprintln(w, "---") }
+}
+
+// splitFiles holds the -split-dir files opened so far by name, so namespaces
+// that sanitise to the same name share a file; a nil entry records a file
+// that couldn't be created, so the error is reported once.
+var splitFiles = map[string]*os.File{}
+
+// writeSplit appends a query to its namespace's file, creating it on first use.
+func writeSplit(ns, query string) {
+	name := splitFileName(ns)
+	f, seen := splitFiles[name]
+	if !seen {
+		var err error
+		if f, err = os.Create(filepath.Join(config.SplitDir, name)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating output file for %s: %v\n", ns, err)
+			f = nil
+		}
+		splitFiles[name] = f
+	}
+	if f != nil { writeQuery(f, query) }
+}
+
+// splitFileName maps a namespace to a file name: characters that are unsafe in
+// file names (collection names may contain slashes, for one) become '_'.
+func splitFileName(ns string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == '_' || r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)) { return r }
+		return '_'
+	}, ns) + ".js"
+}
+
+func closeSplitFiles() {
+	for _, name := range sortedKeys(splitFiles) {
+		f := splitFiles[name]
+		if f == nil { continue }
+		if err := f.Close(); err != nil { fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", name, err) }
+	}
+}
+
+func printGroups() {
+	namespaces := sortedKeys(groupedQueries)
+	for _, ns := range namespaces {
+		fmt.Fprintf(output, "// === %s ===\n", ns)
+		for _, query := range groupedQueries[ns] { printQuery(query) }
+	}
+}
+
+// printScript writes the buffered queries as a runnable script. Statements are
+// separated by blank lines rather than "---", which isn't valid JavaScript.
+// With -group-by-ns the statements of each database are ordered by collection.
+func printScript() {
+	databases := sortedKeys(scriptQueries)
+	for _, db := range databases {
+		fmt.Fprintf(output, "use %s\n\n", db)
+		entries := scriptQueries[db]
+		if config.GroupByNS { sort.SliceStable(entries, func(i, j int) bool { return entries[i].collection < entries[j].collection }) }
+		prefix := fmt.Sprintf("db.getSiblingDB('%s')", singleQuoteEscaper.Replace(db))
+		for _, entry := range entries {
+			query := strings.ReplaceAll(entry.query, prefix, "db")
+			if config.Color { query = colorize(query) }
+			fmt.Fprintf(output, "%s\n\n", query)
+		}
+	}
+}
+
+func printCounts() {
+	rows := make([]opCount, 0, len(operationCounts)); for row := range operationCounts { rows = append(rows, row) }
+	sort.Slice(rows, func(i, j int) bool {
+		if ci, cj := operationCounts[rows[i]], operationCounts[rows[j]]; ci != cj { return ci > cj }
+		if rows[i].ns != rows[j].ns { return rows[i].ns < rows[j].ns }
+		return rows[i].op < rows[j].op
+	})
+	w := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tOPERATION\tCOUNT")
+	for _, row := range rows { fmt.Fprintf(w, "%s\t%s\t%d\n", row.ns, row.op, operationCounts[row]) }
+	w.Flush()
+}
+
+func printStats(w io.Writer) {
+	fmt.Fprintf(w, "lines read:       %d\n", stats.lines)
+	fmt.Fprintf(w, "json entries:     %d\n", stats.json)
+	fmt.Fprintf(w, "legacy lines:     %d\n", stats.legacy)
+	fmt.Fprintf(w, "queries produced: %d\n", stats.queries)
+	ops := sortedKeys(stats.operations)
+	for _, op := range ops { fmt.Fprintf(w, "  %-16s%d\n", op+":", stats.operations[op]) }
+	total := 0; for _, n := range stats.durations { total += n }
+	if total == 0 { return }
+	fmt.Fprintf(w, "durations:\n")
+	for i, n := range stats.durations { fmt.Fprintf(w, "  %-16s%d\n", durationBucketLabel(i)+":", n) }
+}
+
+// recordDuration counts a query's duration in its histogram bucket.
+func recordDuration(ms int64) {
+	i := 0
+	for i < len(durationBuckets) && ms >= durationBuckets[i] { i++ }
+	stats.durations[i]++
+}
+
+func durationBucketLabel(i int) string {
+	switch {
+	case i == 0:
+		return "<" + formatMillis(durationBuckets[0])
+	case i == len(durationBuckets):
+		return ">=" + formatMillis(durationBuckets[i-1])
+	}
+	return formatMillis(durationBuckets[i-1]) + "-" + formatMillis(durationBuckets[i])
+}
+
+func formatMillis(ms int64) string {
+	if ms >= 1000 && ms%1000 == 0 { return fmt.Sprintf("%ds", ms/1000) }
+	return fmt.Sprintf("%dms", ms)
+}
+
+// sortedKeys returns a map's keys in sorted order. Everything l2q prints from
+// a map goes through it so output is the same from run to run.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m { keys = append(keys, k) }
+	sort.Strings(keys)
+	return keys
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+const (
+	colorKey      = "\x1b[36m"
+	colorOperator = "\x1b[35m"
+	colorMethod   = "\x1b[33m"
+	colorReset    = "\x1b[0m"
+)
+
+// colorize decorates an already rendered query: quoted keys, $-operator keys
+// and method calls such as .find( or .explain( are wrapped in ANSI colours.
+// String values are copied through untouched.
+func colorize(query string) string {
+	var b strings.Builder
+	for i := 0; i < len(query); {
+		switch c := query[i]; {
+		case c == '"':
+			end := i + 1
+			for end < len(query) && query[end] != '"' {
+				if query[end] == '\\' { end++ }
+				end++
+			}
+			if end < len(query) { end++ }
+			token := query[i:end]
+			if rest := strings.TrimLeft(query[end:], " "); strings.HasPrefix(rest, ":") {
+				color := colorKey; if strings.HasPrefix(token, `"$`) { color = colorOperator }
+				token = color + token + colorReset
+			}
+			b.WriteString(token)
+			i = end
+		case c == '.':
+			end := i + 1
+			for end < len(query) && isIdentifier(query[i+1:end+1]) { end++ }
+			if end > i+1 && end < len(query) && query[end] == '(' {
+				b.WriteString("." + colorMethod + query[i+1:end] + colorReset)
+			} else {
+				b.WriteString(query[i:end])
+			}
+			i = end
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// -----------------------------------------------------------------------------
+// Logic for Modern JSON Logs (MongoDB 4.4+)
+// -----------------------------------------------------------------------------
+
+func processLineJSON(logEntry map[string]interface{}) {
+	if !inTimeWindow(jsonTimestamp(logEntry)) { return }
+	attr, ok := logEntry["attr"].(map[string]interface{})
+	if !ok { stats.unparsed++; return }
+	command, ok := commandDocument(attr["command"])
+	if !ok {
+		// Most log entries (connections, elections, ...) carry no command;
+		// only a slow query that lacks one means the format has changed.
+		if logEntry["msg"] == "Slow query" { stats.unparsed++ }
+		return
+	}
+	// A getMore is logged with the query that opened its cursor under
+	// attr.originatingCommand. That query is converted instead, with a comment
+	// saying the logged duration is the getMore's.
+	_, fromGetMore := command["getMore"]
+	if fromGetMore {
+		if command, ok = commandDocument(attr["originatingCommand"]); !ok { stats.unparsed++; return }
+	}
+	// An explain is converted as the command it wraps, which is sent without
+	// its own $db; queries end in .explain() anyway unless -no-explain is
+	// given, with the logged verbosity.
+	explainVerbosity, depthWarned = "", false
+	if inner, ok := command["explain"].(map[string]interface{}); ok {
+		if _, ok := inner["$db"]; !ok && command["$db"] != nil { inner["$db"] = command["$db"] }
+		explainVerbosity, _ = command["verbosity"].(string)
+		command = inner
+	}
+	command = withDecodedPipeline(command)
+	ns, ok := attr["ns"].(string)
+	if !ok {
+		if ns, ok = namespaceFromCommand(command); !ok { stats.unparsed++; return }
+	}
+
+	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) < 2 { stats.unparsed++; return }
+	stats.parsed++
+	database := parts[0]
+	collection := parts[1]
+
+	op, handler := lookupHandler(command, collection)
+	if handler == nil {
+		if config.Strict { fmt.Fprintf(os.Stderr, "warning: unsupported command %q on %s\n", commandName(command, collection), ns) }
+		return
+	}
+	// mongos and views can log an ns other than the collection the command
+	// names. The logged ns is used, with a comment noting the difference;
+	// only a "db.$cmd" ns, which names no collection, yields to the command.
+	named := commandCollection(command, op)
+	if collection == "$cmd" && named != "" { collection = named }
+	// bulkWrite is run on admin and names the namespaces of its ops in
+	// nsInfo; its handler selects each op by the namespace it writes to.
+	if !opSelected(op) || op != "bulkWrite" && !nsSelected(database, collection, command) { return }
+	if config.Redact { command = redactCommand(command) }
+	statements := handler(database, collection, command)
+	if len(statements) > 0 {
+		if ms, ok := jsonDuration(attr); ok { recordDuration(ms) }
+	}
+	entryDuration.ms, entryDuration.ok = jsonDuration(attr)
+	if config.FieldUsage && len(statements) > 0 { recordFieldUsage(database+"."+collection, op, command) }
+	for _, st := range statements {
+		database, collection, query := st.database, st.collection, st.query
+		if config.DocOnly {
+			emit(op, database, collection, query)
+			continue
+		}
+		if failure, ok := jsonFailure(attr); ok { query = fmt.Sprintf("// NOTE: this operation failed: %s\n%s", failure, query) }
+		if fromGetMore { query = "// getMore: the originating query of the cursor; the duration is the getMore's, not this query's\n" + query }
+		if named != "" && named != collection { query = fmt.Sprintf("// command names collection %q, logged on %s.%s (a view?)\n%s", named, database, collection, query) }
+		if config.ShowClient {
+			if app := clientAppName(attr, command); app != "" { query = fmt.Sprintf("// appName: %s\n%s", app, query) }
+		}
+		if config.ShowWinningPlan {
+			if line := jsonPlanSummary(attr); line != "" { query = fmt.Sprintf("// %s\n%s", line, query) }
+		}
+		if config.ShowExecStats {
+			if line := jsonExecStats(attr); line != "" { query = fmt.Sprintf("// %s\n%s", line, query) }
+		}
+		if config.ShowShards {
+			if routing := shardTargeting(attr); routing != "" { query = fmt.Sprintf("// %s\n%s", routing, query) }
+		}
+		if config.ShowQueryHash {
+			if ids := queryIdentifiers(attr); ids != "" { query = fmt.Sprintf("// %s\n%s", ids, query) }
+		}
+		if config.IndexSuggestion && op == "find" {
+			if index := suggestIndex(command); index != "" {
+				query += fmt.Sprintf("\n// suggested index: %s.createIndex(%s)", collectionRef(database, collection), index)
+			}
+		}
+		if config.Suggest && containsKey(command, "$where") { query = "// WARNING: $where forces a COLLSCAN\n" + query }
+		if config.Suggest {
+			if order, ok := naturalHint(command); ok { query = fmt.Sprintf("// WARNING: the $natural hint forces a COLLSCAN in %s order, whatever indexes exist\n%s", order, query) }
+		}
+		if config.Suggest {
+			for _, hint := range suggestGeoIndexes(database, collection, command) { query += "\n// suggestion: " + hint }
+			if usesTextSearch(command) {
+				query += "\n// suggestion: $text requires a text index on the searched fields"
+				warnings := ""
+				for _, field := range nonTextScoreSortFields(command) {
+					warnings += fmt.Sprintf("// WARNING: sorting a $text query by %q needs an in-memory sort; sort by { $meta: \"textScore\" } for relevance order\n", field)
+				}
+				query = warnings + query
+			}
+		}
+		if config.Suggest && op == "aggregate" {
+			if pipeline, ok := command["pipeline"].([]interface{}); ok {
+				if hint := suggestCount(database, collection, pipeline); hint != "" { query += "\n// suggestion: " + hint }
+				if target := writeTarget(database, pipeline); target != "" { query += "\n// note: the pipeline writes to " + target }
+				if hasStage(pipeline, "$sample") { query += "\n// note: $sample picks documents with a random cursor and doesn't use indexes on the sampled collection" }
+			}
+		}
+		if config.Header {
+			ms, ok := jsonDuration(attr)
+			query = queryHeader(database, collection, op, ms, ok) + query
+		}
+		emit(op, database, collection, query)
+	}
+}
+
+// commandHandler converts a logged command document into shell statements.
+type commandHandler func(database, collection string, command map[string]interface{}) []statement
+
+// statement is one reconstructed query and the namespace it runs on: the
+// logged one, except for commands such as bulkWrite that name their own.
+type statement struct{ database, collection, query string }
+
+// onNamespace pairs each query with the namespace database.collection.
+func onNamespace(database, collection string, queries ...string) []statement {
+	statements := make([]statement, len(queries))
+	for i, query := range queries { statements[i] = statement{database, collection, query} }
+	return statements
+}
+
+// commandHandlers maps command names to the handler reconstructing them. New
+// operations are added with registerHandler.
+var commandHandlers = map[string]commandHandler{}
+
+func registerHandler(name string, handler commandHandler) { commandHandlers[name] = handler }
+
+func init() {
+	registerHandler("find", handleFindJSON)
+	registerHandler("aggregate", handleAggregateJSON)
+	registerHandler("mapReduce", handleMapReduceJSON)
+	registerHandler("update", handleUpdateJSON)
+	registerHandler("delete", handleDeleteJSON)
+	registerHandler("findAndModify", handleFindAndModifyJSON)
+	registerHandler("bulkWrite", handleBulkWriteJSON)
+}
+
+// handlerName returns the registered name matching op case-insensitively.
+func handlerName(op string) (string, bool) {
+	for name := range commandHandlers {
+		if strings.EqualFold(name, op) { return name, true }
+	}
+	return "", false
+}
+
+// opSelected reports whether -op lets operation op through.
+func opSelected(op string) bool { return config.Ops == nil || config.Ops[op] }
+
+// internalDatabases hold the server's own data: users and roles (admin),
+// sharding metadata (config) and the oplog (local). Replication and config
+// server traffic on them is rarely the query being looked for.
+var internalDatabases = map[string]bool{"admin": true, "config": true, "local": true}
+
+// nsSelected reports whether -ns matches the command's namespace or one of the
+// collections its pipeline reads through $lookup, $graphLookup or $unionWith.
+// command may be nil when only the namespace is known. -collection-regex must
+// match the collection itself as well. Commands on the
+// server's own databases are left out unless -include-internal is given.
+func nsSelected(database, collection string, command map[string]interface{}) bool {
+	if internalDatabases[database] && !config.IncludeInternal { return false }
+	if config.CollectionRegex != nil && !config.CollectionRegex.MatchString(collection) { return false }
+	if config.NamespaceGlob == "" { return true }
+	if ok, _ := path.Match(config.NamespaceGlob, database+"."+collection); ok { return true }
+	pipeline, _ := command["pipeline"].([]interface{})
+	for _, ns := range pipelineNamespaces(database, pipeline) {
+		if ok, _ := path.Match(config.NamespaceGlob, ns); ok { return true }
+	}
+	return false
+}
+
+// pipelineNamespaces lists the namespaces a pipeline's stages read from,
+// including those of nested sub-pipelines ($lookup, $unionWith, $facet).
+func pipelineNamespaces(database string, pipeline []interface{}) []string {
+	var namespaces []string
+	for _, s := range pipeline {
+		stage, _ := s.(map[string]interface{})
+		for _, name := range sortedKeys(stage) {
+			var from interface{}
+			var sub []interface{}
+			switch operand := stage[name].(type) {
+			case string:
+				if name == "$unionWith" { from = operand }
+			case map[string]interface{}:
+				switch name {
+				case "$lookup", "$graphLookup":
+					from = operand["from"]
+				case "$unionWith":
+					from = operand["coll"]
+				case "$facet":
+					for _, facet := range sortedKeys(operand) {
+						if p, ok := operand[facet].([]interface{}); ok { sub = append(sub, p...) }
+					}
+				}
+				if p, ok := operand["pipeline"].([]interface{}); ok && name != "$facet" { sub = p }
+			}
+			// $lookup may also name a collection in another database: {db, coll}.
+			switch f := from.(type) {
+			case string:
+				namespaces = append(namespaces, database+"."+f)
+			case map[string]interface{}:
+				db, _ := f["db"].(string); coll, _ := f["coll"].(string)
+				if db != "" && coll != "" { namespaces = append(namespaces, db+"."+coll) }
+			}
+			namespaces = append(namespaces, pipelineNamespaces(database, sub)...)
+		}
+	}
+	return namespaces
+}
+
+// lookupHandler finds the registered handler for a command document and
+// returns it with the name it was registered under. Names match
+// case-insensitively (the server accepts "mapreduce" for "mapReduce"). As with
+// commandName, a key whose value is the collection name wins when several
+// registered names appear in the command.
+func lookupHandler(command map[string]interface{}, collection string) (string, commandHandler) {
+	keys := sortedKeys(command)
+	name := ""
+	for _, k := range keys {
+		for registered := range commandHandlers {
+			if !strings.EqualFold(k, registered) { continue }
+			if v, ok := command[k].(string); ok && v == collection { return registered, commandHandlers[registered] }
+			if name == "" { name = registered }
+		}
+	}
+	if name == "" { return "", nil }
+	return name, commandHandlers[name]
+}
+
+// withDecodedPipeline decodes a pipeline that a log shipper stringified, the
+// way commandDocument decodes a stringified command, so that the handlers and
+// filters all see the array.
+func withDecodedPipeline(command map[string]interface{}) map[string]interface{} {
+	encoded, ok := command["pipeline"].(string)
+	if !ok { return command }
+	v, err := decodeValue([]byte(encoded))
+	pipeline, ok := v.([]interface{})
+	if err != nil || !ok { return command }
+	decoded := make(map[string]interface{}, len(command))
+	for k, v := range command { decoded[k] = v }
+	decoded["pipeline"] = pipeline
+	return decoded
+}
+
+// commandCollection returns the collection named by the command's op key, as
+// in {"find": "orders"}, or "" when the value isn't a collection name.
+func commandCollection(command map[string]interface{}, op string) string {
+	for k, v := range command {
+		if name, ok := v.(string); ok && strings.EqualFold(k, op) { return name }
+	}
+	return ""
+}
+
+// commandDocument returns attr.command as a document. Some log shippers
+// stringify it, so a string holding a JSON document is decoded as well.
+func commandDocument(v interface{}) (map[string]interface{}, bool) {
+	if command, ok := v.(map[string]interface{}); ok { return command, true }
+	encoded, ok := v.(string)
+	if !ok { return nil, false }
+	command, err := decodeDocument(json.NewDecoder(strings.NewReader(encoded)))
+	if err != nil { return nil, false }
+	return command, true
+}
+
+// orderedKeys name the documents whose key order is part of their meaning: a
+// sort on {lastName: 1, firstName: 1} is not one on {firstName: 1,
+// lastName: 1}, and a hint names an index by its key pattern.
+var orderedKeys = map[string]bool{"sort": true, "$sort": true, "sortBy": true, "hint": true}
+
+// decodeDocument reads the next JSON document from d. Like the rest of the
+// decoding, numbers come back as json.Number; see decodeValue.
+func decodeDocument(d *json.Decoder) (map[string]interface{}, error) {
+	var raw json.RawMessage
+	if err := d.Decode(&raw); err != nil { return nil, err }
+	v, err := decodeValue(raw)
+	if err != nil { return nil, err }
+	doc, ok := v.(map[string]interface{})
+	if !ok { return nil, fmt.Errorf("not a JSON document: %.20s", raw) }
+	return doc, nil
+}
+
+// decodeValue decodes one JSON value with numbers as json.Number. The
+// operands of orderedKeys come back as a stageOperand listing their keys in
+// the order they were logged, which a map would lose. Values that mention
+// none of the keys take the faster plain decoding.
+func decodeValue(raw []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	for key := range orderedKeys {
+		if bytes.Contains(raw, []byte(`"`+key+`"`)) { return decodeOrdered(d, false) }
+	}
+	var v interface{}
+	err := d.Decode(&v)
+	return v, err
+}
+
+// decodeOrdered decodes the next value from d token by token; a document is
+// returned as a stageOperand in logged order when ordered is set.
+func decodeOrdered(d *json.Decoder, ordered bool) (interface{}, error) {
+	t, err := d.Token()
+	if err != nil { return nil, err }
+	switch t {
+	case json.Delim('{'):
+		doc := map[string]interface{}{}
+		var keys []string
+		for d.More() {
+			k, err := d.Token()
+			if err != nil { return nil, err }
+			key, _ := k.(string)
+			v, err := decodeOrdered(d, orderedKeys[key])
+			if err != nil { return nil, err }
+			if _, seen := doc[key]; !seen { keys = append(keys, key) }
+			doc[key] = v
+		}
+		if _, err := d.Token(); err != nil { return nil, err }
+		if ordered { return stageOperand{doc, keys}, nil }
+		return doc, nil
+	case json.Delim('['):
+		items := []interface{}{}
+		for d.More() {
+			v, err := decodeOrdered(d, false)
+			if err != nil { return nil, err }
+			items = append(items, v)
+		}
+		if _, err := d.Token(); err != nil { return nil, err }
+		return items, nil
+	}
+	return t, nil
+}
+
+// orderedDocument returns a decoded document and its keys in order: as logged
+// for the operands of orderedKeys, sorted for any other.
+func orderedDocument(v interface{}) (map[string]interface{}, []string, bool) {
+	switch d := v.(type) {
+	case map[string]interface{}:
+		return d, sortedKeys(d), true
+	case stageOperand:
+		return d.doc, d.keys(), true
+	}
+	return nil, nil, false
+}
+
+// namespaceFromCommand rebuilds the namespace of entries logged without
+// attr.ns from the command's $db and the collection named by the operation
+// key, e.g. {"find": "orders", "$db": "shop"}. A bulkWrite names no
+// collection and gets the database's $cmd namespace.
+func namespaceFromCommand(command map[string]interface{}) (string, bool) {
+	database, ok := command["$db"].(string)
+	if !ok { return "", false }
+	if _, ok := command["bulkWrite"]; ok { return database + ".$cmd", true }
+	keys := sortedKeys(command)
+	for _, k := range keys {
+		collection, ok := command[k].(string)
+		if !ok { continue }
+		for registered := range commandHandlers {
+			if strings.EqualFold(k, registered) { return database + "." + collection, true }
+		}
+	}
+	return "", false
+}
+
+// commandName guesses the name of a command document. The name is the
+// first key of the command, which decoding into a map loses, so prefer the
+// key whose value is the collection name (as in {"count": "orders"}).
+func commandName(command map[string]interface{}, collection string) string {
+	keys := sortedKeys(command)
+	for _, k := range keys {
+		if v, ok := command[k].(string); ok && v == collection && !strings.HasPrefix(k, "$") { return k }
+	}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, "$") { return k }
+	}
+	return ""
+}
+
+// execStatFields are the execution counters reported by -show-exec-stats, in
+// output order. Large nreturned or reslen values point at missing projections
+// or limits.
+var execStatFields = []string{"keysExamined", "docsExamined", "nreturned", "reslen"}
+
+// jsonExecStats formats the execution counters of a JSON entry, skipping
+// absent or non-numeric fields. Profiler documents call reslen responseLength.
+func jsonExecStats(attr map[string]interface{}) string {
+	var parts []string
+	for _, field := range execStatFields {
+		value, ok := attr[field].(json.Number)
+		if !ok && field == "reslen" { value, ok = attr["responseLength"].(json.Number) }
+		if ok { parts = append(parts, fmt.Sprintf("%s: %s", field, value)) }
+	}
+	return strings.Join(parts, ", ")
+}
+
+// jsonPlanSummary describes the logged plan. Profiler documents carry the
+// executed stage tree in execStats, which is summarised with the indexes it
+// used; slow query log lines only have the server's planSummary string.
+func jsonPlanSummary(attr map[string]interface{}) string {
+	if execStats, ok := attr["execStats"].(map[string]interface{}); ok {
+		var indexes []string
+		if stages := planStages(execStats, &indexes); stages != "" {
+			if len(indexes) == 0 { return "winning plan: " + stages }
+			return fmt.Sprintf("winning plan: %s (index: %s)", stages, strings.Join(indexes, ", "))
+		}
+	}
+	if summary, ok := attr["planSummary"].(string); ok && summary != "" { return "plan summary: " + summary }
+	return ""
+}
+
+// planStages renders a stage tree as "FETCH > IXSCAN", with the children of
+// multi-input stages in parentheses, and collects the index names it meets.
+// Nodes without a stage name end the walk, since the layout varies by version.
+func planStages(node map[string]interface{}, indexes *[]string) string {
+	stage, ok := node["stage"].(string)
+	if !ok { return "" }
+	if index, ok := node["indexName"].(string); ok { *indexes = append(*indexes, index) }
+	if child, ok := node["inputStage"].(map[string]interface{}); ok {
+		if rendered := planStages(child, indexes); rendered != "" { return stage + " > " + rendered }
+		return stage
+	}
+	children, _ := node["inputStages"].([]interface{})
+	var rendered []string
+	for _, c := range children {
+		if child, ok := c.(map[string]interface{}); ok {
+			if r := planStages(child, indexes); r != "" { rendered = append(rendered, r) }
+		}
+	}
+	if len(rendered) == 0 { return stage }
+	return fmt.Sprintf("%s(%s)", stage, strings.Join(rendered, ", "))
+}
+
+// jsonDuration returns how long an entry's operation took: durationMillis in
+// slow query logs, millis in profiler documents.
+func jsonDuration(attr map[string]interface{}) (int64, bool) {
+	for _, field := range []string{"durationMillis", "millis"} {
+		if d, ok := attr[field].(json.Number); ok {
+			if ms, err := d.Int64(); err == nil { return ms, true }
+		}
+	}
+	return 0, false
+}
+
+// shardTargeting summarises the routing metadata mongos adds to its slow
+// query entries: the number of shards targeted (attr.nShards) and, when
+// logged, their names (attr.shards, either a list or a document keyed by
+// shard). mongod entries have neither and yield "".
+func shardTargeting(attr map[string]interface{}) string {
+	var names []string
+	switch shards := attr["shards"].(type) {
+	case []interface{}:
+		for _, shard := range shards {
+			if name, ok := shard.(string); ok { names = append(names, name) }
+		}
+	case map[string]interface{}:
+		for name := range shards { names = append(names, name) }
+		sort.Strings(names)
+	}
+	n, hasCount := attr["nShards"].(json.Number)
+	switch {
+	case hasCount && len(names) > 0:
+		return fmt.Sprintf("nShards: %s (%s)", n, strings.Join(names, ", "))
+	case hasCount:
+		return fmt.Sprintf("nShards: %s", n)
+	case len(names) > 0:
+		return fmt.Sprintf("shards: %s", strings.Join(names, ", "))
+	}
+	return ""
+}
+
+// queryIdentifiers lists the identifiers a slow query entry carries for
+// cross-referencing other diagnostics: attr.queryHash and attr.planCacheKey
+// (see $planCacheStats) and attr.cursorid (see currentOp). Absent ones are
+// left out, so an entry with none yields "".
+func queryIdentifiers(attr map[string]interface{}) string {
+	var fields []string
+	for _, k := range []string{"queryHash", "planCacheKey", "cursorid"} {
+		switch v := attr[k].(type) {
+		case string:
+			if v != "" { fields = append(fields, k+": "+v) }
+		case json.Number:
+			fields = append(fields, k+": "+v.String())
+		}
+	}
+	return strings.Join(fields, ", ")
+}
+
+// jsonTimestamp parses the entry's "t": {"$date": ...} field.
+func jsonTimestamp(logEntry map[string]interface{}) (time.Time, bool) {
+	t, ok := logEntry["t"].(map[string]interface{})
+	if !ok { return time.Time{}, false }
+	date, ok := t["$date"].(string)
+	if !ok { return time.Time{}, false }
+	parsed, err := time.Parse(time.RFC3339Nano, date)
+	return parsed, err == nil
+}
+
+// jsonFailure reports whether the logged operation failed, with attr.ok 0 or
+// an attr.errMsg, and describes the error: errMsg (errmsg in some versions),
+// then errName or the numeric errCode. Write concern errors are reported too,
+// since the write itself succeeded but wasn't acknowledged as asked.
+func jsonFailure(attr map[string]interface{}) (string, bool) {
+	message := ""
+	for _, k := range []string{"errMsg", "errmsg"} {
+		if m, ok := attr[k].(string); ok && m != "" { message = m; break }
+	}
+	if name, ok := attr["errName"].(string); ok && name != "" {
+		if message == "" { message = name } else { message = name + ": " + message }
+	} else if code, ok := attr["errCode"].(json.Number); ok && message == "" {
+		message = "error code " + code.String()
+	}
+	failed := message != ""
+	if n, ok := attr["ok"].(json.Number); ok && n.String() == "0" { failed = true }
+	if wce, ok := attr["writeConcernError"].(map[string]interface{}); ok {
+		failed = true
+		if m, ok := wce["errmsg"].(string); ok {
+			if message != "" { message += "; " }
+			message += "write concern error: " + m
+		}
+	}
+	if !failed { return "", false }
+	if message == "" { message = "ok: 0" }
+	// The message is a comment, so a newline in it must not end the comment.
+	return strings.ReplaceAll(message, "\n", " "), true
+}
+
+// naturalHint reports whether the command is hinted {$natural: 1} or
+// {$natural: -1}, a collection scan in forward or reverse insertion order,
+// and which of the two.
+func naturalHint(command map[string]interface{}) (string, bool) {
+	hint, _, _ := orderedDocument(command["hint"])
+	direction, ok := hint["$natural"].(json.Number)
+	if !ok { return "", false }
+	if strings.HasPrefix(direction.String(), "-") { return "reverse natural", true }
+	return "natural", true
+}
+
+// clientAppName finds the application name of the client that issued the
+// command. Depending on server and driver version it is logged as attr.appName
+// or inside the client metadata document under command.$client.
+func clientAppName(attr, command map[string]interface{}) string {
+	if app, ok := attr["appName"].(string); ok && app != "" { return app }
+	client, ok := command["$client"].(map[string]interface{})
+	if !ok { return "" }
+	application, ok := client["application"].(map[string]interface{})
+	if !ok { return "" }
+	app, _ := application["name"].(string)
+	return app
+}
+
+func handleFindJSON(database, collection string, command map[string]interface{}) []statement {
+	query := openCall(explainTarget(database, collection), "find")
+	filter := "{}"
+	if f, ok := command["filter"]; ok { filter = toShellDocument(f) }
+	if config.DocOnly { return onNamespace(database, collection, filter) }
+	query += filter
+	// Options that have no cursor method, such as let, go in mongosh's third
+	// find() argument, which needs an (empty) projection in front of it.
+	options := map[string]interface{}{}
+	if l, ok := command["let"]; ok { options["let"] = l }
+	if p, ok := command["projection"]; ok { query += nextArg() + toShellDocument(idFirst(p)) } else if len(options) > 0 { query += nextArg() + "{}" }
+	if len(options) > 0 { query += nextArg() + toShellDocument(options) }
+	query += closeCall()
+	if s, ok := command["sort"]; ok { query += fmt.Sprintf(".sort(%s)", toShellFormat(sortDirections(s), false, 0)) }
+	if h, ok := command["hint"]; ok { query += fmt.Sprintf(".hint(%s)", toShellFormat(h, false, 0)) }
+	if s, ok := command["skip"]; ok { query += fmt.Sprintf(".skip(%s)", toShellFormat(s, false, 0)) }
+	// The shell has no singleBatch method; a negative limit asks for a single
+	// batch of that many documents. Both cursor flags are noted in a comment.
+	var mapped []string
+	singleBatch, _ := command["singleBatch"].(bool)
+	if l, ok := command["limit"]; ok {
+		limit := toShellFormat(l, false, 0)
+		if n, ok := l.(json.Number); singleBatch && ok && n != "0" && !strings.HasPrefix(string(n), "-") {
+			limit = "-" + limit
+			mapped = append(mapped, fmt.Sprintf("singleBatch -> .limit(%s)", limit))
+			singleBatch = false
+		}
+		query += fmt.Sprintf(".limit(%s)", limit)
+	}
+	if singleBatch { mapped = append(mapped, "singleBatch has no shell equivalent without a limit") }
+	if b, ok := command["batchSize"]; ok { query += fmt.Sprintf(".batchSize(%s)", toShellFormat(b, false, 0)) }
+	if m, ok := maxTimeMS(command); ok { query += fmt.Sprintf(".maxTimeMS(%s)", m) }
+	if c, ok := command["comment"].(string); ok { query += fmt.Sprintf(".comment(%s)", toShellFormat(c, false, 0)) }
+	if n, _ := command["noCursorTimeout"].(bool); n {
+		query += ".noCursorTimeout()"
+		mapped = append(mapped, "noCursorTimeout -> .noCursorTimeout()")
+	}
+	if len(mapped) > 0 { query = fmt.Sprintf("// %s\n%s", strings.Join(mapped, ", "), query) }
+	return onNamespace(database, collection, commentLine(command)+query+explainSuffix())
+}
+
+func handleAggregateJSON(database, collection string, command map[string]interface{}) []statement {
+	pipeline, ok := command["pipeline"]
+	if !ok { return nil }
+	pipeline, merged := withoutMergeCursors(pipeline)
+	if config.DocOnly { return onNamespace(database, collection, toShellDocument(pipeline)) }
+	if query, ok := changeStreamQuery(database, collection, command, pipeline); ok { return onNamespace(database, collection, query) }
+	query := openCall(explainTarget(database, collection), "aggregate") + toShellDocument(pipeline)
+	options := map[string]interface{}{}
+	if l, ok := command["let"]; ok { options["let"] = l }
+	if c, ok := command["comment"].(string); ok { options["comment"] = c }
+	if m, ok := maxTimeMS(command); ok { options["maxTimeMS"] = m }
+	// The aggregate command carries its batch size inside the cursor document.
+	if cursor, ok := command["cursor"].(map[string]interface{}); ok {
+		if b, ok := cursor["batchSize"]; ok { options["cursor"] = map[string]interface{}{"batchSize": b} }
+	}
+	if len(options) > 0 { query += nextArg() + toShellDocument(options) }
+	query += closeCall()
+	if stage := writeStage(pipeline); stage != "" { query = writeStageWarning(stage) + query }
+	if merged { query = "// $mergeCursors removed: this is the merging half of a pipeline split across shards\n" + query }
+	return onNamespace(database, collection, commentLine(command)+query+explainSuffix())
+}
+
+// explainSuffix ends find and aggregate queries: .explain(), unless
+// -no-explain asks for the runnable query or -explain-style prefix has
+// explainTarget put it in front.
+func explainSuffix() string {
+	if config.NoExplain || config.ExplainPrefix { return "" }
+	return explainCall()
+}
+
+// explainTarget is the collection a find or aggregate is called on: with
+// -explain-style prefix, its explain() wrapper.
+func explainTarget(database, collection string) string {
+	if config.ExplainPrefix && !config.NoExplain { return collectionRef(database, collection) + explainCall() }
+	return collectionRef(database, collection)
+}
+
+// explainCall is .explain(), given the verbosity of a logged explain.
+func explainCall() string {
+	if explainVerbosity == "" { return ".explain()" }
+	return ".explain(" + quoteString(explainVerbosity) + ")"
+}
+
+// maxTimeMS returns the time limit for a find or aggregate: the
+// -inject-max-time-ms cap when replaying with -no-explain, else the logged
+// value if it is numeric.
+func maxTimeMS(command map[string]interface{}) (json.Number, bool) {
+	if config.NoExplain && config.InjectMaxTimeMS > 0 { return json.Number(strconv.Itoa(config.InjectMaxTimeMS)), true }
+	m, ok := command["maxTimeMS"].(json.Number)
+	return m, ok
+}
+
+// changeStreamQuery reconstructs a pipeline led by $changeStream as a watch()
+// call: the remaining stages become its pipeline and the $changeStream
+// options its options. {aggregate: 1} watches the whole database. A change
+// stream can't be explained, so there is no .explain().
+func changeStreamQuery(database, collection string, command map[string]interface{}, pipeline interface{}) (string, bool) {
+	stages, _ := pipeline.([]interface{})
+	if len(stages) == 0 { return "", false }
+	first, _ := stages[0].(map[string]interface{})
+	options, ok := first["$changeStream"]
+	if !ok || len(first) != 1 { return "", false }
+
+	target := collectionRef(database, collection)
+	if _, named := command["aggregate"].(string); !named { target = fmt.Sprintf("db.getSiblingDB('%s')", singleQuoteEscaper.Replace(database)) }
+	rest := stages[1:]; if rest == nil { rest = []interface{}{} }
+	query := "// change stream: reconstructed with watch() rather than aggregate()\n" + openCall(target, "watch") + toShellDocument(rest)
+	if doc, ok := options.(map[string]interface{}); ok && len(doc) > 0 { query += nextArg() + toShellDocument(doc) }
+	return commentLine(command) + query + closeCall(), true
+}
+
+// withoutMergeCursors drops the $mergeCursors stage mongos (or a merging
+// shard) puts in front of the merging half of a split pipeline. It names
+// internal cursors and can't be run from the shell.
+func withoutMergeCursors(pipeline interface{}) (interface{}, bool) {
+	stages, ok := pipeline.([]interface{})
+	if !ok || !hasStage(stages, "$mergeCursors") { return pipeline, false }
+	var kept []interface{}
+	for _, s := range stages {
+		if stage, ok := s.(map[string]interface{}); ok {
+			if _, ok := stage["$mergeCursors"]; ok { continue }
+		}
+		kept = append(kept, s)
+	}
+	return kept, true
+}
+
+// writeStage returns the $out or $merge stage of a pipeline, if any.
+func writeStage(pipeline interface{}) string {
+	stages, _ := pipeline.([]interface{})
+	for _, name := range []string{"$out", "$merge"} {
+		if hasStage(stages, name) { return name }
+	}
+	return ""
+}
+
+// writeStageWarning flags pipelines that write data: explain() is harmless,
+// but running the aggregation itself would write.
+func writeStageWarning(stage string) string {
+	return fmt.Sprintf("// WARNING: pipeline ends with %s and will write data\n", stage)
+}
+
+// sortDirections rewrites the directions of a sort document as integers, so
+// a 1.0 or -1.0 from the log renders as 1 or -1 however it was decoded.
+// Non-numeric directions such as { $meta: "textScore" } are kept, and so is
+// the order of the fields.
+func sortDirections(spec interface{}) interface{} {
+	doc, keys, ok := orderedDocument(spec)
+	if !ok { return spec }
+	normalised := make(map[string]interface{}, len(doc))
+	for field, direction := range doc {
+		var f float64
+		var err error
+		switch d := direction.(type) {
+		case json.Number:
+			f, err = d.Float64()
+		case float64:
+			f = d
+		default:
+			err = fmt.Errorf("not a number")
+		}
+		if err == nil && f == math.Trunc(f) { direction = json.Number(strconv.FormatInt(int64(f), 10)) }
+		normalised[field] = direction
+	}
+	return stageOperand{normalised, keys}
+}
+
+// commentLine renders a non-string command comment (drivers may attach whole
+// documents for tracing) as a // line placed above the query. String comments
+// are carried into the query itself.
+func commentLine(command map[string]interface{}) string {
+	c, ok := command["comment"]
+	if _, isString := c.(string); !ok || isString { return "" }
+	return fmt.Sprintf("// comment: %s\n", toShellFormat(c, false, 0))
+}
+
+// handleFindAndModifyJSON renders findAndModify as the mongosh method for
+// its variant: findOneAndDelete for remove: true, findOneAndReplace for a
+// replacement document and findOneAndUpdate otherwise, with new: true
+// becoming returnDocument: "after". The legacy update style keeps the
+// findAndModify() shell method and its options as logged.
+func handleFindAndModifyJSON(database, collection string, command map[string]interface{}) []statement {
+	filter, ok := command["query"]
+	if !ok { filter = map[string]interface{}{} }
+	if config.DocOnly { return onNamespace(database, collection, toShellDocument(filter)) }
+	remove, _ := command["remove"].(bool)
+	update, hasUpdate := command["update"]
+	if remove == hasUpdate { return nil } // exactly one of them is required
+
+	if config.UpdateStyle == "legacy" {
+		spec := map[string]interface{}{"query": filter}
+		for _, k := range []string{"sort", "remove", "update", "new", "fields", "upsert", "arrayFilters", "collation", "hint", "let", "writeConcern"} {
+			if v, ok := command[k]; ok { spec[k] = v }
+		}
+		return onNamespace(database, collection, openCall(collectionRef(database, collection), "findAndModify")+toShellDocument(spec)+closeCall())
+	}
+
+	options := map[string]interface{}{}
+	for option, k := range map[string]string{"projection": "fields", "sort": "sort", "collation": "collation", "hint": "hint", "let": "let", "writeConcern": "writeConcern"} {
+		if v, ok := command[k]; ok { options[option] = v }
+	}
+	if p, ok := options["projection"]; ok { options["projection"] = idFirst(p) }
+	if s, ok := options["sort"]; ok { options["sort"] = sortDirections(s) }
+	if m, ok := maxTimeMS(command); ok { options["maxTimeMS"] = m }
+	if remove {
+		query := openCall(collectionRef(database, collection), "findOneAndDelete") + toShellDocument(filter)
+		if len(options) > 0 { query += nextArg() + toShellFormat(options, false, 0) }
+		return onNamespace(database, collection, query+closeCall())
+	}
+
+	if upsert, _ := command["upsert"].(bool); upsert { options["upsert"] = true }
+	if returnNew, _ := command["new"].(bool); returnNew { options["returnDocument"] = "after" }
+	method := "findOneAndUpdate"
+	if doc, ok := update.(map[string]interface{}); ok && !hasOperatorKeys(doc) {
+		method = "findOneAndReplace"
+	} else if af, ok := command["arrayFilters"]; ok {
+		options["arrayFilters"] = af
+	}
+	query := openCall(collectionRef(database, collection), method) + toShellDocument(filter) + nextArg() + toShellDocument(update)
+	if len(options) > 0 { query += nextArg() + toShellFormat(options, false, 0) }
+	if _, isPipeline := update.([]interface{}); isPipeline { query = "// update with an aggregation pipeline\n" + query }
+	return onNamespace(database, collection, query+closeCall())
+}
+
+func handleMapReduceJSON(database, collection string, command map[string]interface{}) []statement {
+	mapFn, ok := command["map"]
+	if !ok { return nil }
+	reduceFn, ok := command["reduce"]
+	if !ok { return nil }
+	if config.DocOnly {
+		filter, ok := command["query"]
+		if !ok { filter = map[string]interface{}{} }
+		return onNamespace(database, collection, toShellDocument(filter))
+	}
+
+	options := map[string]interface{}{}
+	for _, k := range []string{"out", "query", "sort", "limit", "finalize", "scope"} {
+		if v, ok := command[k]; ok { options[k] = v }
+	}
+	if f, ok := options["finalize"].(string); ok { options["finalize"] = map[string]interface{}{"$code": f} }
+
+	query := openCall(collectionRef(database, collection), "mapReduce") + jsFunction(mapFn) + nextArg() + jsFunction(reduceFn)
+	if len(options) > 0 { query += nextArg() + toShellDocument(options) }
+	return onNamespace(database, collection, query+closeCall())
+}
+
+// handleUpdateJSON emits one statement per entry of the update command's
+// "updates" array.
+func handleUpdateJSON(database, collection string, command map[string]interface{}) []statement {
+	updates, ok := command["updates"].([]interface{})
+	if !ok { return nil }
+	var queries []string
+	for _, u := range updates {
+		entry, ok := u.(map[string]interface{})
+		if !ok { continue }
+		q, ok := entry["q"]
+		if !ok { continue }
+		update, ok := entry["u"]
+		if !ok { continue }
+		if config.DocOnly {
+			queries = append(queries, toShellDocument(q))
+			continue
+		}
+		queries = append(queries, updateStatement(database, collection, q, update, entry, command))
+	}
+	return onNamespace(database, collection, queries...)
+}
+
+// updateStatement renders one update of filter q with update document or
+// pipeline u, taking multi, upsert and arrayFilters from the statement entry
+// and writeConcern from the command.
+func updateStatement(database, collection string, q, update interface{}, entry, command map[string]interface{}) string {
+	multi, _ := entry["multi"].(bool)
+	upsert, _ := entry["upsert"].(bool)
+
+	doc, isDoc := update.(map[string]interface{})
+	method := updateMethod(isDoc && !hasOperatorKeys(doc), multi)
+	options := map[string]interface{}{}
+	if config.UpdateStyle == "legacy" && multi { options["multi"] = true }
+	if upsert { options["upsert"] = true }
+	if af, ok := entry["arrayFilters"]; ok { options["arrayFilters"] = af }
+	addWriteConcern(options, command)
+
+	query := openCall(collectionRef(database, collection), method) + toShellDocument(q) + nextArg() + toShellDocument(update)
+	if len(options) > 0 { query += nextArg() + toShellFormat(options, false, 0) }
+	// Since 4.2 u may be an aggregation pipeline, which computes the new
+	// document from the old one instead of applying update operators.
+	if _, isPipeline := update.([]interface{}); isPipeline { query = "// update with an aggregation pipeline\n" + query }
+	return query + closeCall()
+}
+
+// updateMethod picks the shell method for one update statement: update() in
+// the legacy style, otherwise replaceOne for a replacement document and
+// updateMany or updateOne depending on multi.
+func updateMethod(replacement, multi bool) string {
+	switch {
+	case config.UpdateStyle == "legacy":
+		return "update"
+	case replacement:
+		return "replaceOne"
+	case multi:
+		return "updateMany"
+	}
+	return "updateOne"
+}
+
+func handleDeleteJSON(database, collection string, command map[string]interface{}) []statement {
+	deletes, ok := command["deletes"].([]interface{})
+	if !ok { return nil }
+	var queries []string
+	for _, d := range deletes {
+		entry, ok := d.(map[string]interface{})
+		if !ok { continue }
+		q, ok := entry["q"]
+		if !ok { continue }
+		if config.DocOnly {
+			queries = append(queries, toShellDocument(q))
+			continue
+		}
+		queries = append(queries, deleteStatement(database, collection, q, fmt.Sprint(entry["limit"]) == "1", command))
+	}
+	return onNamespace(database, collection, queries...)
+}
+
+// openCall, nextArg and closeCall lay out the arguments of a statement's
+// call: each top-level argument starts a line of its own, unless -minify
+// asks for one line per statement.
+func openCall(target, method string) string { return target + "." + method + "(" + argBreak() }
+
+func nextArg() string { return "," + argBreak() }
+
+func closeCall() string { return argBreak() + ")" }
+
+func argBreak() string {
+	if config.Minify { return "" }
+	return "\n"
+}
+
+// deleteStatement renders one delete of the documents matching q, taking
+// writeConcern from the command.
+func deleteStatement(database, collection string, q interface{}, justOne bool, command map[string]interface{}) string {
+	query := openCall(collectionRef(database, collection), deleteMethod(justOne)) + toShellDocument(q)
+	options := map[string]interface{}{}
+	if justOne && config.UpdateStyle == "legacy" { options["justOne"] = true }
+	addWriteConcern(options, command)
+	if len(options) > 0 { query += nextArg() + toShellFormat(options, false, 0) }
+	return query + closeCall()
+}
+
+// addWriteConcern copies the command's writeConcern into the options of one
+// of its writes.
+func addWriteConcern(options, command map[string]interface{}) {
+	if wc, ok := command["writeConcern"].(map[string]interface{}); ok { options["writeConcern"] = wc }
+}
+
+// handleBulkWriteJSON emits one statement per entry of the "ops" array of a
+// bulkWrite command (MongoDB 8.0). Each op names its namespace by index into
+// nsInfo, so the ops of one command may write to several collections; ops on
+// a namespace -ns or -collection-regex leaves out are skipped.
+func handleBulkWriteJSON(_, _ string, command map[string]interface{}) []statement {
+	ops, ok := command["ops"].([]interface{})
+	if !ok { return nil }
+	var statements []statement
+	for _, o := range ops {
+		entry, ok := o.(map[string]interface{})
+		if !ok { continue }
+		kind, index := bulkWriteOp(entry)
+		database, collection, ok := bulkWriteNamespace(command, index)
+		if !ok || kind == "" || !nsSelected(database, collection, nil) { continue }
+		filter, ok := entry["filter"]
+		if !ok { filter = map[string]interface{}{} }
+		switch kind {
+		case "insert":
+			document, ok := entry["document"]
+			if !ok { continue }
+			if config.DocOnly { statements = append(statements, statement{database, collection, toShellDocument(document)}); continue }
+			method := "insertOne"
+			if config.UpdateStyle == "legacy" { method = "insert" }
+			query := openCall(collectionRef(database, collection), method) + toShellDocument(document)
+			options := map[string]interface{}{}
+			addWriteConcern(options, command)
+			if len(options) > 0 { query += nextArg() + toShellFormat(options, false, 0) }
+			statements = append(statements, statement{database, collection, query + closeCall()})
+		case "update":
+			update, ok := entry["updateMods"]
+			if !ok { continue }
+			if config.DocOnly { statements = append(statements, statement{database, collection, toShellDocument(filter)}); continue }
+			statements = append(statements, statement{database, collection, updateStatement(database, collection, filter, update, entry, command)})
+		case "delete":
+			if config.DocOnly { statements = append(statements, statement{database, collection, toShellDocument(filter)}); continue }
+			multi, _ := entry["multi"].(bool)
+			statements = append(statements, statement{database, collection, deleteStatement(database, collection, filter, !multi, command)})
+		}
+	}
+	return statements
+}
+
+// bulkWriteOp returns the kind of a bulkWrite op (insert, update or delete)
+// and the nsInfo index it is keyed by, e.g. {"update": 1, "filter": ...}.
+func bulkWriteOp(entry map[string]interface{}) (string, int) {
+	for _, kind := range []string{"insert", "update", "delete"} {
+		n, ok := entry[kind].(json.Number)
+		if !ok { continue }
+		if i, err := strconv.Atoi(n.String()); err == nil { return kind, i }
+	}
+	return "", 0
+}
+
+// bulkWriteNamespace splits the namespace at index i of a bulkWrite
+// command's nsInfo into database and collection.
+func bulkWriteNamespace(command map[string]interface{}, i int) (database, collection string, ok bool) {
+	nsInfo, _ := command["nsInfo"].([]interface{})
+	if i < 0 || i >= len(nsInfo) { return "", "", false }
+	info, _ := nsInfo[i].(map[string]interface{})
+	ns, _ := info["ns"].(string)
+	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) < 2 { return "", "", false }
+	return parts[0], parts[1], true
+}
+
+// deleteMethod picks the shell method for one delete statement; a limit of 1
+// deletes a single document. The legacy style uses remove().
+func deleteMethod(justOne bool) string {
+	switch {
+	case config.UpdateStyle == "legacy":
+		return "remove"
+	case justOne:
+		return "deleteOne"
+	}
+	return "deleteMany"
+}
+
+// hasOperatorKeys reports whether doc is an update-operator document such as
+// {"$set": ...} rather than a replacement document.
+func hasOperatorKeys(doc map[string]interface{}) bool {
+	for k := range doc {
+		if strings.HasPrefix(k, "$") { return true }
+	}
+	return false
+}
+
+// jsFunction renders a map/reduce/finalize function verbatim. Drivers send
+// these either as plain strings or as $code values.
+func jsFunction(fn interface{}) string {
+	if s, ok := fn.(string); ok { return s }
+	return toShellFormat(fn, false, 0)
+}
+
+// collectionRef returns the shell expression for a collection. Names that
+// aren't valid JavaScript identifiers, such as "system.profile", "with-dash"
+// or "123numeric", can't be written as a property access and go through
+// getCollection() instead.
+func collectionRef(database, collection string) string {
+	db := fmt.Sprintf("db.getSiblingDB('%s')", singleQuoteEscaper.Replace(database))
+	if !isIdentifier(collection) { return fmt.Sprintf("%s.getCollection(%q)", db, collection) }
+	return db + "." + collection
+}
+
+// singleQuoteEscaper escapes a string for use inside a single-quoted
+// JavaScript string literal.
+var singleQuoteEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+func isIdentifier(name string) bool {
+	if name == "" { return false }
+	for i, r := range name {
+		if r >= '0' && r <= '9' && i == 0 { return false }
+		if !(r == '_' || r == '$' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') { return false }
+	}
+	return true
+}
+
+// renderDepthLimit is the default -max-depth. Rendered output grows with the
+// square of the depth, so pathological filters from untrusted logs (thousands
+// of nested $and levels) would otherwise take minutes to print.
+const renderDepthLimit = 100
+
+// depthWarned records that the entry being converted has been warned about
+// nesting cut at renderDepthLimit, so a query warns once and not per branch.
+var depthWarned bool
+
+// tooDeep reports whether a node at level is past -max-depth. A cut at the
+// default is warned about, since the query no longer matches what was logged
+// and the user didn't ask for it.
+func tooDeep(level int) bool {
+	if config.MaxDepth <= 0 || level < config.MaxDepth { return false }
+	if config.MaxDepth == renderDepthLimit && !depthWarned {
+		depthWarned = true
+		fmt.Fprintf(os.Stderr, "warning: query nested deeper than %d levels truncated at %s:%d; -max-depth 0 renders it whole\n", renderDepthLimit, position.name, position.line)
+	}
+	return true
+}
+
+// toShellDocument renders one of a query's top-level documents: pretty, or
+// compact when -minify is set or -pretty-threshold is and the compact form
+// fits in it.
+func toShellDocument(data interface{}) string {
+	if config.Minify { return toShellFormat(data, false, 0) }
+	if config.PrettyThreshold > 0 {
+		if compact := toShellFormat(data, false, 0); utf8.RuneCountInString(compact) <= config.PrettyThreshold { return compact }
+	}
+	return toShellFormat(data, true, 0)
+}
+
+// toShellFormat renders a decoded document as mongo shell syntax. level is the
+// nesting depth of data: in pretty mode its members are indented one step
+// deeper than level and its closing bracket sits at level, so top-level
+// documents are rendered with level 0.
+func toShellFormat(data interface{}, pretty bool, level int) string {
+	indent := ""; if pretty { indent = indentation(level + 1) }
+	closingIndent := ""; if pretty { closingIndent = indentation(level) }
+
+	switch v := data.(type) {
+	case json.Number:
+		return v.String()
+	case map[string]interface{}:
+		keys := sortedKeys(v)
+		return renderDocument(v, keys, pretty, level)
+	case stageOperand:
+		return renderDocument(v.doc, v.keys(), pretty, level)
+
+	case []interface{}:
+		if tooDeep(level) { return "[ /* ... */ ]" }
+		if pretty && config.InlineArrays > 0 && len(v) > config.InlineArrays && isScalarArray(v) { return toShellFormat(v, false, level) }
+		if len(v) == 0 { return "[]" }
+		more := ""
+		if config.MaxArrayElements > 0 && len(v) > config.MaxArrayElements {
+			more = fmt.Sprintf(" /* +%d more */", len(v)-config.MaxArrayElements)
+			v = v[:config.MaxArrayElements]
+		}
+		// Elements are rendered one level deeper, so a multi-line element's own
+		// lines already line up; only its first line needs the indent.
+		var parts []string; for _, item := range v { parts = append(parts, indent+toShellFormat(item, pretty, level+1)) }
+		separator := compactSeparator(); if pretty { separator = ",\n" }
+		if pretty { return fmt.Sprintf("[\n%s%s\n%s]", strings.Join(parts, separator), more, closingIndent) }
+		return fmt.Sprintf("[%s%s]", strings.Join(parts, separator), more)
+	case string: return quoteString(truncateString(v))
+	case nil: return "null"
+	default: return fmt.Sprintf("%v", v)
+	}
+}
+
+// renderDocument renders a document with its members in the given key order.
+func renderDocument(v map[string]interface{}, keys []string, pretty bool, level int) string {
+	if literal, ok := ejsonLiteral(v); ok { return literal }
+	if literal, ok := regexOperator(v); ok { return literal }
+	if tooDeep(level) { return "{ /* ... */ }" }
+	if len(v) == 0 { return "{}" }
+	indent := ""; if pretty { indent = indentation(level + 1) }
+
+	var parts []string
+	for _, k := range keys {
+		child := v[k]; if k == "$function" { child = rawFunctionBody(child) }
+		if order, ok := stageFieldOrder[k]; ok {
+			if doc, ok := child.(map[string]interface{}); ok { child = stageOperand{doc, order} }
+		}
+		keyPart := quoteString(k); valPart := toShellFormat(child, pretty, level+1)
+		if pretty { parts = append(parts, fmt.Sprintf("%s%s: %s", indent, keyPart, valPart))
+		} else if config.Minify { parts = append(parts, keyPart+":"+valPart)
+		} else { parts = append(parts, fmt.Sprintf("%s: %s", keyPart, valPart)) }
+	}
+	separator := compactSeparator(); if pretty { separator = ",\n" }
+	if pretty { return fmt.Sprintf("{\n%s\n%s}", strings.Join(parts, separator), indentation(level)) }
+	if config.Minify { return "{" + strings.Join(parts, separator) + "}" }
+	return fmt.Sprintf("{ %s }", strings.Join(parts, separator))
+}
+
+// compactSeparator separates the members of a compact document or array.
+func compactSeparator() string {
+	if config.Minify { return "," }
+	return ", "
+}
+
+// stageFieldOrder lists the fields of stages that read much better in their
+// documented order than alphabetically: sorted, $graphLookup would put "as"
+// first and startWith last. Projections list _id first, where it is
+// expected, although "_" sorts after upper-case letters, and the date
+// operators read from the largest unit down. Sorts are not reordered at all:
+// their field order is the sort order.
+var stageFieldOrder = map[string][]string{
+	"$graphLookup":   {"from", "startWith", "connectFromField", "connectToField", "as", "maxDepth", "depthField", "restrictSearchWithMatch"},
+	"$lookup":        {"from", "localField", "foreignField", "let", "pipeline", "as"},
+	"$project":       {"_id"},
+	"$dateFromParts": {"year", "isoWeekYear", "month", "isoWeek", "day", "isoDayOfWeek", "hour", "minute", "second", "millisecond", "timezone"},
+	"$dateToString":  {"date", "format", "timezone", "onNull"},
+}
+
+// idFirst renders a find's projection document with _id first, as
+// stageFieldOrder does for the $project stage.
+func idFirst(v interface{}) interface{} {
+	if doc, ok := v.(map[string]interface{}); ok { return stageOperand{doc, stageFieldOrder["$project"]} }
+	return v
+}
+
+// stageOperand is a stage's operand document rendered in stageFieldOrder.
+type stageOperand struct {
+	doc   map[string]interface{}
+	order []string
+}
+
+// keys returns the listed fields present in the document followed by any
+// others in sorted order.
+func (s stageOperand) keys() []string {
+	var keys, rest []string
+	listed := map[string]bool{}
+	for _, k := range s.order {
+		listed[k] = true
+		if _, ok := s.doc[k]; ok { keys = append(keys, k) }
+	}
+	for k := range s.doc {
+		if !listed[k] { rest = append(rest, k) }
+	}
+	sort.Strings(rest)
+	return append(keys, rest...)
+}
+
+// regexOperator renders a {"$regex": "p", "$options": "i"} operator document
+// as /p/i when -collapse-regex is set. Filters carry regexes in two forms: the
+// EJSON {"$regularExpression": {"pattern", "options"}} wrapper, a BSON regex
+// value that ejsonLiteral renders as a literal when it can, and this query
+// operator, which is kept as a document by default since it is valid shell
+// as it stands. A field matched against a regex literal is the same query as
+// one using the operator.
+func regexOperator(v map[string]interface{}) (string, bool) {
+	if !config.CollapseRegex { return "", false }
+	pattern, ok := v["$regex"].(string)
+	if !ok { return "", false }
+	options, hasOptions := v["$options"].(string)
+	if len(v) == 1 || len(v) == 2 && hasOptions { return regexLiteral(pattern, options) }
+	return "", false
+}
+
+// truncateString keeps the first config.TruncateStrings characters of a long string
+// and notes its full length, e.g. "aGVsbG8…(5012 chars)".
+func truncateString(s string) string {
+	if config.TruncateStrings <= 0 || utf8.RuneCountInString(s) <= config.TruncateStrings { return s }
+	runes := []rune(s)
+	return fmt.Sprintf("%s…(%d chars)", string(runes[:config.TruncateStrings]), len(runes))
+}
+
+// quoteString renders a double-quoted JavaScript string literal. JSON string
+// syntax is valid JavaScript, so the encoder does the escaping; HTML escaping
+// is turned off to keep <, > and & readable.
+func quoteString(s string) string {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// rawFunctionBody prepares the argument of a $function expression so its body
+// string is rendered as a JavaScript function rather than a quoted string.
+func rawFunctionBody(fn interface{}) interface{} {
+	m, ok := fn.(map[string]interface{})
+	if !ok { return fn }
+	body, ok := m["body"].(string)
+	if !ok { return fn }
+	copied := make(map[string]interface{}, len(m)); for k, v := range m { copied[k] = v }
+	copied["body"] = map[string]interface{}{"$code": body}
+	return copied
+}
+
+// indentation returns the indent for a nesting level. Negative levels are
+// clamped to zero since strings.Repeat panics on a negative count.
+func indentation(level int) string {
+	if level < 0 { level = 0 }
+	return strings.Repeat(config.Indent, level)
+}
+
+// parseIndentFlag turns an -indent value, "tab" or a number of spaces, into
+// the indent unit, exiting on anything else.
+func parseIndentFlag(value string) string {
+	if value == "tab" { return "\t" }
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		fmt.Fprintf(os.Stderr, "invalid -indent value %q: want tab or a number of spaces\n", value)
+		os.Exit(2)
+	}
+	return strings.Repeat(" ", n)
+}
+
+const oidPlaceholder = `ObjectId("<id>")`
+
+// legacyObjectID matches an ObjectId in legacy log text.
+var legacyObjectID = regexp.MustCompile(`ObjectId\(['"][0-9a-fA-F]{24}['"]\)`)
+
+var jsonNumberLiteral = regexp.MustCompile(`^-?(?:0|[1-9]\d*)(?:\.\d+)?(?:[eE][-+]?\d+)?$`)
 
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading from stdin: %v\n", err)
+// ejsonLiteral renders Extended JSON type wrappers ({"$oid": ...},
+// {"$date": ...}, ...) as shell literals. Only the canonical EJSON type keys
+// are recognised, so single-key documents holding query or aggregation
+// operators such as {"$expr": ...} or {"$jsonSchema": ...} are never mistaken
+// for a type wrapper and render as ordinary documents; neither is
+// {"$meta": "textScore"}, although it too holds a single string.
+func ejsonLiteral(v map[string]interface{}) (string, bool) {
+	// Wrappers only match the scalar values EJSON produces; any other shape is an
+	// ordinary document (or a stage operand) and is rendered structurally.
+	if literal, ok := dbRefLiteral(v); ok { return literal, true }
+	if len(v) != 1 { return ejsonCode(v) }
+	if val, ok := v["$oid"].(string); ok {
+		if config.ReplaceOIDs { return oidPlaceholder, true }
+		return fmt.Sprintf(`ObjectId("%s")`, val), true
+	}
+	if val, ok := v["$date"].(string); ok { return fmt.Sprintf(`ISODate("%s")`, val), true }
+	// Canonical EJSON dates hold milliseconds since the epoch.
+	if val, ok := v["$date"].(map[string]interface{}); ok && len(val) == 1 {
+		if ms, ok := val["$numberLong"].(string); ok {
+			if n, err := strconv.ParseInt(ms, 10, 64); err == nil { return fmt.Sprintf(`ISODate("%s")`, time.UnixMilli(n).UTC().Format("2006-01-02T15:04:05.000Z")), true }
+		}
+	}
+	if val, ok := v["$numberInt"].(string); ok {
+		if config.PreserveNumberTypes { return fmt.Sprintf("NumberInt(%s)", val), true }
+		return val, true
+	}
+	// A decimal stays NumberDecimal() when its digits don't form a JavaScript
+	// number literal, as with "NaN" or "Infinity".
+	if val, ok := v["$numberDecimal"].(string); ok {
+		if !config.PreserveNumberTypes && jsonNumberLiteral.MatchString(val) { return val, true }
+		return fmt.Sprintf(`NumberDecimal("%s")`, val), true
 	}
+	// NumberLong takes a string so 64-bit values beyond a double's 53-bit
+	// mantissa survive unchanged.
+	switch val := v["$numberLong"].(type) {
+	case string:
+		return fmt.Sprintf(`NumberLong("%s")`, val), true
+	case json.Number:
+		return fmt.Sprintf(`NumberLong("%s")`, val), true
+	}
+	if val, ok := v["$regularExpression"]; ok && len(v) == 1 {
+		if reMap, ok := val.(map[string]interface{}); ok {
+			pattern, _ := reMap["pattern"].(string); options, _ := reMap["options"].(string)
+			if literal, ok := regexLiteral(pattern, options); ok { return literal, true }
+			return fmt.Sprintf("BSONRegExp(%s, %s)", quoteString(pattern), quoteString(regexFlags(options))), true
+		}
+	}
+	return ejsonCode(v)
 }
 
-func processLine(line []byte) {
-	var logEntry map[string]interface{}
-	decoder := json.NewDecoder(bytes.NewReader(line))
-	decoder.UseNumber()
+// dbRefLiteral renders {$ref, $id[, $db]} as the shell's DBRef(); the id is
+// rendered like any value, so an $oid wrapper becomes ObjectId().
+func dbRefLiteral(v map[string]interface{}) (string, bool) {
+	ref, ok := v["$ref"].(string)
+	id, hasID := v["$id"]
+	if !ok || !hasID { return "", false }
+	switch db, hasDB := v["$db"].(string); {
+	case len(v) == 2:
+		return fmt.Sprintf("DBRef(%s, %s)", quoteString(ref), toShellFormat(id, false, 0)), true
+	case len(v) == 3 && hasDB:
+		return fmt.Sprintf("DBRef(%s, %s, %s)", quoteString(ref), toShellFormat(id, false, 0), quoteString(db)), true
+	}
+	return "", false
+}
 
-	if err := decoder.Decode(&logEntry); err == nil {
-		if _, ok := logEntry["attr"]; ok {
-			processLineJSON(logEntry)
-			return
+// ejsonCode renders $code wrappers. A function expression is emitted raw so
+// the shell sees a function, not a string; any other code, such as the
+// this.a == 1 of a $where, is not an expression that can stand as a value
+// and is quoted, which the server accepts as well. The shell has no literal
+// for code with scope, so the scope is kept as a comment.
+func ejsonCode(v map[string]interface{}) (string, bool) {
+	code, ok := v["$code"].(string)
+	if !ok { return "", false }
+	if !isFunctionExpression(code) { code = quoteString(code) }
+	if len(v) == 1 { return code, true }
+	if scope, ok := v["$scope"]; ok && len(v) == 2 { return fmt.Sprintf("/* scope: %s */ %s", toShellFormat(scope, false, 0), code), true }
+	return "", false
+}
+
+// functionExpression matches the start of a function expression, named or
+// not: function (doc) or function mapper(doc).
+var functionExpression = regexp.MustCompile(`^function(?:\s+[A-Za-z_$][\w$]*)?\s*\(`)
+
+// isFunctionExpression reports whether code is a whole function(...) { ... }
+// expression.
+func isFunctionExpression(code string) bool {
+	code = strings.TrimSpace(code)
+	return functionExpression.MatchString(code) && strings.HasSuffix(code, "}")
+}
+
+// regexLiteral renders a /pattern/options literal. Unescaped slashes in the
+// pattern would end the literal early, so they are escaped; options are
+// limited to the flags MongoDB accepts (imsxu) and written in sorted order.
+// JavaScript has no x (extended) flag, so with it there is no literal and
+// regexLiteral returns false.
+func regexLiteral(pattern, options string) (string, bool) {
+	flags := regexFlags(options)
+	if strings.Contains(flags, "x") { return "", false }
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			b.WriteByte(c); i++; b.WriteByte(pattern[i])
+		case c == '/':
+			b.WriteString(`\/`)
+		default:
+			b.WriteByte(c)
 		}
 	}
-	processLineLegacy(line)
+	return fmt.Sprintf("/%s/%s", b.String(), flags), true
+}
+
+// regexFlags keeps the flags MongoDB accepts (imsxu) of options, sorted.
+func regexFlags(options string) string {
+	var flags []string
+	for _, option := range []string{"i", "m", "s", "u", "x"} {
+		if strings.Contains(options, option) { flags = append(flags, option) }
+	}
+	return strings.Join(flags, "")
+}
+
+// isScalarArray reports whether every element of the array renders as a single
+// value: numbers, strings, booleans, null and EJSON literals such as ObjectIds.
+func isScalarArray(items []interface{}) bool {
+	for _, item := range items {
+		switch v := item.(type) {
+		case json.Number, string, bool, nil:
+		case map[string]interface{}:
+			if _, ok := ejsonLiteral(v); !ok { return false }
+		default:
+			return false
+		}
+	}
+	return true
 }
 
 // -----------------------------------------------------------------------------
-// Logic for Modern JSON Logs (MongoDB 4.4+)
+// Query analysis heuristics
 // -----------------------------------------------------------------------------
 
-func processLineJSON(logEntry map[string]interface{}) {
-	attr, ok := logEntry["attr"].(map[string]interface{})
-	if !ok { return }
-	command, ok := attr["command"].(map[string]interface{})
-	if !ok { return }
-	ns, ok := attr["ns"].(string)
-	if !ok { return }
+// suggestIndex proposes an index for a find using the ESR rule: equality
+// fields first, then the sort fields, then fields matched by a range. It
+// returns "" when the filter and sort reference no fields. Sort keys keep
+// the order they were logged in.
+func suggestIndex(command map[string]interface{}) string {
+	var equality, ranges []string
+	if filter, ok := command["filter"].(map[string]interface{}); ok { equality, ranges = classifyPredicates(filter) }
+	sortSpec, sortFields, _ := orderedDocument(sortDirections(command["sort"]))
 
-	parts := strings.SplitN(ns, ".", 2)
-	if len(parts) < 2 { return }
-	database := parts[0]
-	collection := parts[1]
+	var keys []string
+	seen := map[string]bool{}
+	add := func(field, direction string) {
+		if seen[field] { return }
+		seen[field] = true
+		keys = append(keys, fmt.Sprintf(`"%s": %s`, field, direction))
+	}
+	for _, field := range equality { add(field, "1") }
+	for _, field := range sortFields {
+		if direction, ok := sortSpec[field].(json.Number); ok { add(field, direction.String()) }
+	}
+	for _, field := range ranges { add(field, "1") }
+	if len(keys) == 0 { return "" }
+	return fmt.Sprintf("{ %s }", strings.Join(keys, ", "))
+}
+
+// fieldCombinations holds the -field-usage counts by namespace and field
+// combination.
+var fieldCombinations = map[string]map[string]int{}
+
+// queryFilters returns the filters of a command: the find filter, the first
+// $match of a pipeline, the mapReduce query or each update and delete q.
+func queryFilters(op string, command map[string]interface{}) []map[string]interface{} {
+	var filters []map[string]interface{}
+	add := func(v interface{}) {
+		if filter, ok := v.(map[string]interface{}); ok { filters = append(filters, filter) }
+	}
+	switch op {
+	case "find":
+		add(command["filter"])
+	case "mapReduce", "findAndModify":
+		add(command["query"])
+	case "aggregate":
+		if pipeline, ok := command["pipeline"].([]interface{}); ok && len(pipeline) > 0 {
+			if stage, ok := pipeline[0].(map[string]interface{}); ok { add(stage["$match"]) }
+		}
+	case "update", "delete":
+		statements, _ := command[op+"s"].([]interface{})
+		for _, s := range statements {
+			if entry, ok := s.(map[string]interface{}); ok { add(entry["q"]) }
+		}
+	}
+	return filters
+}
 
-	if _, ok := command["find"]; ok {
-		handleFindJSON(database, collection, command)
-	} else if _, ok := command["aggregate"]; ok {
-		handleAggregateJSON(database, collection, command)
+// recordFieldUsage counts the field combination of each of the command's
+// filters. A combination lists its equality fields, then its range fields
+// marked "(range)", each group sorted; an empty filter counts as "(none)".
+func recordFieldUsage(ns, op string, command map[string]interface{}) {
+	for _, filter := range queryFilters(op, command) {
+		if fieldCombinations[ns] == nil { fieldCombinations[ns] = map[string]int{} }
+		equality, ranges := classifyPredicates(filter)
+		sort.Strings(equality); sort.Strings(ranges)
+		fields := equality
+		for _, field := range ranges { fields = append(fields, field+" (range)") }
+		combination := strings.Join(fields, ", ")
+		if combination == "" { combination = "(none)" }
+		fieldCombinations[ns][combination]++
 	}
 }
 
-func handleFindJSON(database, collection string, command map[string]interface{}) {
-	query := fmt.Sprintf("db.getSiblingDB('%s').%s.find(\n", database, collection)
-	filter := "{}"
-	if f, ok := command["filter"]; ok { filter = toShellFormat(f, true, 1) }
-	query += filter
-	if p, ok := command["projection"]; ok { query += ",\n" + toShellFormat(p, true, 1) }
-	query += "\n)"
-	if s, ok := command["sort"]; ok { query += fmt.Sprintf(".sort(%s)", toShellFormat(s, false, 0)) }
-	if s, ok := command["skip"]; ok { query += fmt.Sprintf(".skip(%v)", s) }
-	if l, ok := command["limit"]; ok { query += fmt.Sprintf(".limit(%s)", toShellFormat(l, false, 0)) }
-	fmt.Println(query + ".explain()")
-	fmt.Println("---")
+// printFieldUsage writes the -field-usage report: namespaces in sorted order,
+// each with its field combinations, most used first.
+func printFieldUsage(w io.Writer) {
+	fmt.Fprintln(w, "field usage:")
+	for _, ns := range sortedKeys(fieldCombinations) {
+		counts := fieldCombinations[ns]
+		combinations := sortedKeys(counts)
+		sort.SliceStable(combinations, func(i, j int) bool { return counts[combinations[i]] > counts[combinations[j]] })
+		fmt.Fprintf(w, "  %s\n", ns)
+		for _, c := range combinations { fmt.Fprintf(w, "    %-6d%s\n", counts[c], c) }
+	}
 }
 
-func handleAggregateJSON(database, collection string, command map[string]interface{}) {
-	pipeline, ok := command["pipeline"]
+// suggestCount recognises pipelines that only count matching documents,
+// [{$match}, {$count}] or [{$match}, {$group: {_id: null, n: {$sum: 1}}}], and
+// suggests the equivalent countDocuments() call.
+func suggestCount(database, collection string, pipeline []interface{}) string {
+	if len(pipeline) != 2 { return "" }
+	first, _ := pipeline[0].(map[string]interface{})
+	second, _ := pipeline[1].(map[string]interface{})
+	match, ok := first["$match"]
+	if !ok || len(first) != 1 || len(second) != 1 { return "" }
+
+	if _, ok := second["$count"]; !ok {
+		group, ok := second["$group"].(map[string]interface{})
+		if !ok || len(group) < 2 { return "" }
+		if id, ok := group["_id"]; !ok || id != nil { return "" }
+		for field, acc := range group {
+			if field == "_id" { continue }
+			sum, ok := acc.(map[string]interface{})
+			if !ok || len(sum) != 1 || fmt.Sprint(sum["$sum"]) != "1" { return "" }
+		}
+	}
+	return fmt.Sprintf("%s.countDocuments(%s) returns the same count", collectionRef(database, collection), toShellFormat(match, false, 0))
+}
+
+// hasStage reports whether any stage of the pipeline is the named one.
+func hasStage(pipeline []interface{}, name string) bool {
+	for _, s := range pipeline {
+		if stage, ok := s.(map[string]interface{}); ok {
+			if _, ok := stage[name]; ok { return true }
+		}
+	}
+	return false
+}
+
+// writeTarget names the namespace a $out or $merge stage writes to. Both
+// accept a collection name, written to the pipeline's own database, or a
+// {db, coll} document; $merge spells its target "into".
+func writeTarget(database string, pipeline []interface{}) string {
+	for _, s := range pipeline {
+		stage, _ := s.(map[string]interface{})
+		target, ok := stage["$out"]
+		if merge, isMerge := stage["$merge"]; isMerge {
+			target, ok = merge, true
+			if m, isDoc := merge.(map[string]interface{}); isDoc { target = m["into"] }
+		}
+		if !ok { continue }
+		switch t := target.(type) {
+		case string:
+			return database + "." + t
+		case map[string]interface{}:
+			coll, _ := t["coll"].(string)
+			db, ok := t["db"].(string)
+			if !ok { db = database }
+			if coll != "" { return db + "." + coll }
+		}
+	}
+	return ""
+}
+
+var geoOperators = map[string]bool{"$near": true, "$nearSphere": true, "$geoWithin": true, "$geoIntersects": true}
+
+// suggestGeoIndexes recommends a geospatial index for every field the find
+// filter or the pipeline's $match stages query with a geo operator. Shapes
+// given as a GeoJSON $geometry need a 2dsphere index; legacy coordinate pairs
+// and $box/$center/$polygon shapes need a 2d index.
+func suggestGeoIndexes(database, collection string, command map[string]interface{}) []string {
+	var filters []interface{}
+	if f, ok := command["filter"]; ok { filters = append(filters, f) }
+	if pipeline, ok := command["pipeline"].([]interface{}); ok {
+		for _, stage := range pipeline {
+			if m, ok := stage.(map[string]interface{}); ok {
+				if match, ok := m["$match"]; ok { filters = append(filters, match) }
+			}
+		}
+	}
+	indexes := map[string]string{}
+	for _, filter := range filters { collectGeoFields(filter, indexes) }
+
+	fields := sortedKeys(indexes)
+	var hints []string
+	for _, field := range fields {
+		hints = append(hints, fmt.Sprintf("geo query on %q needs a %s index: %s.createIndex({ %q: %q })", field, indexes[field], collectionRef(database, collection), field, indexes[field]))
+	}
+	return hints
+}
+
+func collectGeoFields(filter interface{}, indexes map[string]string) {
+	m, ok := filter.(map[string]interface{})
 	if !ok { return }
-	query := fmt.Sprintf("db.getSiblingDB('%s').%s.aggregate(\n%s\n)", database, collection, toShellFormat(pipeline, true, 1))
-	fmt.Println(query + ".explain()")
-	fmt.Println("---")
+	for field, value := range m {
+		if field == "$and" || field == "$or" || field == "$nor" {
+			clauses, _ := value.([]interface{})
+			for _, clause := range clauses { collectGeoFields(clause, indexes) }
+			continue
+		}
+		predicate, ok := value.(map[string]interface{})
+		if !ok { continue }
+		for op, operand := range predicate {
+			if geoOperators[op] { indexes[field] = geoIndexType(operand) }
+		}
+	}
 }
 
-func toShellFormat(data interface{}, pretty bool, level int) string {
-	indent := ""; if pretty { indent = strings.Repeat("  ", level) }
-	closingIndent := ""; if pretty { closingIndent = strings.Repeat("  ", level-1) }
+func geoIndexType(operand interface{}) string {
+	switch v := operand.(type) {
+	case []interface{}:
+		return "2d"
+	case map[string]interface{}:
+		for _, legacy := range []string{"$box", "$center", "$polygon"} {
+			if _, ok := v[legacy]; ok { return "2d" }
+		}
+	}
+	return "2dsphere"
+}
+
+// usesTextSearch reports whether the find filter or the pipeline's leading
+// $match stage (the only place $text is allowed) performs a $text search.
+func usesTextSearch(command map[string]interface{}) bool {
+	if filter, ok := command["filter"].(map[string]interface{}); ok {
+		if _, ok := filter["$text"]; ok { return true }
+	}
+	if pipeline, ok := command["pipeline"].([]interface{}); ok && len(pipeline) > 0 {
+		if stage, ok := pipeline[0].(map[string]interface{}); ok {
+			if match, ok := stage["$match"].(map[string]interface{}); ok {
+				_, hasText := match["$text"]
+				return hasText
+			}
+		}
+	}
+	return false
+}
+
+// nonTextScoreSortFields lists the find's sort fields that don't sort by
+// { $meta: "textScore" }.
+func nonTextScoreSortFields(command map[string]interface{}) []string {
+	sortSpec, keys, _ := orderedDocument(command["sort"])
+	var fields []string
+	for _, field := range keys {
+		if meta, ok := sortSpec[field].(map[string]interface{}); ok && meta["$meta"] == "textScore" { continue }
+		fields = append(fields, field)
+	}
+	return fields
+}
 
+// containsKey reports whether key appears anywhere in a decoded document.
+func containsKey(data interface{}, key string) bool {
 	switch v := data.(type) {
-	case json.Number:
-		return v.String()
 	case map[string]interface{}:
-		if val, ok := v["$oid"]; ok && len(v) == 1 { return fmt.Sprintf(`ObjectId("%v")`, val) }
-		if val, ok := v["$date"]; ok && len(v) == 1 { return fmt.Sprintf(`ISODate("%v")`, val) }
-		if val, ok := v["$numberInt"]; ok && len(v) == 1 { return fmt.Sprintf("%v", val) }
-		if val, ok := v["$numberLong"]; ok && len(v) == 1 { return fmt.Sprintf("%v", val) }
-		if val, ok := v["$regularExpression"]; ok && len(v) == 1 {
-			if reMap, ok := val.(map[string]interface{}); ok { return fmt.Sprintf(`/%v/%v`, reMap["pattern"], reMap["options"]) }
+		for k, child := range v {
+			if k == key || containsKey(child, key) { return true }
+		}
+	case stageOperand:
+		return containsKey(v.doc, key)
+	case []interface{}:
+		for _, child := range v {
+			if containsKey(child, key) { return true }
+		}
+	}
+	return false
+}
+
+// classifyPredicates splits the fields of a filter into equality matches and
+// range (or otherwise non-equality) matches, descending into $and.
+func classifyPredicates(filter map[string]interface{}) (equality, ranges []string) {
+	fields := sortedKeys(filter)
+	for _, field := range fields {
+		value := filter[field]
+		if field == "$and" {
+			clauses, _ := value.([]interface{})
+			for _, clause := range clauses {
+				if m, ok := clause.(map[string]interface{}); ok {
+					e, r := classifyPredicates(m)
+					equality = append(equality, e...); ranges = append(ranges, r...)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(field, "$") { continue }
+		if isEqualityPredicate(value) { equality = append(equality, field) } else { ranges = append(ranges, field) }
+	}
+	return equality, ranges
+}
+
+func isEqualityPredicate(value interface{}) bool {
+	m, ok := value.(map[string]interface{})
+	if !ok { return true }
+	if _, ok := ejsonLiteral(m); ok { return true }
+	for k := range m {
+		if !strings.HasPrefix(k, "$") { return true } // embedded document match
+	}
+	_, ok = m["$eq"]
+	return ok && len(m) == 1
+}
+
+var (
+	stringLiteral    = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+	numberLiteral    = regexp.MustCompile(`(^|[^\w$.])-?\d+(?:\.\d+)?(?:[eE][-+]?\d+)?`)
+	placeholderArray = regexp.MustCompile(`\[\s*\?(?:\s*,\s*\?)*\s*\]`)
+)
+
+// queryShape normalises a rendered query so that queries differing only in
+// their literal values compare equal: comment lines are dropped, string and
+// number values become ?, and arrays of placeholders collapse to [?]. Quoted
+// keys, operators and collection names in getCollection() are kept. It works
+// on the rendered text so JSON and legacy queries are handled alike.
+func queryShape(query string) string {
+	var lines []string
+	for _, line := range strings.Split(query, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "//") { lines = append(lines, line) }
+	}
+	query = strings.Join(lines, "\n")
+
+	var b strings.Builder
+	last := 0
+	for _, loc := range stringLiteral.FindAllStringIndex(query, -1) {
+		b.WriteString(query[last:loc[0]])
+		rest := strings.TrimLeft(query[loc[1]:], " ")
+		if strings.HasPrefix(rest, ":") || strings.HasSuffix(query[:loc[0]], "getCollection(") {
+			b.WriteString(query[loc[0]:loc[1]])
+		} else {
+			b.WriteString("?")
 		}
+		last = loc[1]
+	}
+	b.WriteString(query[last:])
+
+	shape := numberLiteral.ReplaceAllString(b.String(), "${1}?")
+	return placeholderArray.ReplaceAllString(shape, "[?]")
+}
+
+// -----------------------------------------------------------------------------
+// Redaction
+// -----------------------------------------------------------------------------
+
+// redactedFields are the command fields that hold user data, including the
+// free-form comment and a mapReduce's scope variables. Everything else
+// (collection names, limits, options) is kept so the queries still convert
+// the same way.
+var redactedFields = []string{"filter", "query", "pipeline", "let", "comment", "scope"}
+
+// codeFields are the command fields holding JavaScript, a mapReduce's
+// functions, which can embed constants of their own.
+var codeFields = []string{"map", "reduce", "finalize"}
 
-		var parts []string; keys := make([]string, 0, len(v)); for k := range v { keys = append(keys, k) }; sort.Strings(keys)
-		for _, k := range keys {
-			keyPart := fmt.Sprintf(`"%s"`, k); valPart := toShellFormat(v[k], pretty, level+1)
-			if pretty { parts = append(parts, fmt.Sprintf("%s%s: %s", indent, keyPart, valPart))
-			} else { parts = append(parts, fmt.Sprintf("%s: %s", keyPart, valPart)) }
+// redactedCode replaces JavaScript code. As a $code wrapper that isn't a
+// function it renders as the string "<code>" wherever code is expected.
+func redactedCode() map[string]interface{} { return map[string]interface{}{"$code": "<code>"} }
+
+// redactCommand returns a copy of command with redactedFields and codeFields
+// masked, along with a find's projection, the q, u and arrayFilters of each
+// update, the q of each delete and the filter, updateMods, arrayFilters and
+// document of each bulkWrite op.
+func redactCommand(command map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(command))
+	for k, v := range command { redacted[k] = v }
+	for _, k := range redactedFields {
+		if v, ok := command[k]; ok { redacted[k] = redactValue(v) }
+	}
+	for _, k := range codeFields {
+		if _, ok := command[k]; ok { redacted[k] = redactedCode() }
+	}
+	for _, k := range []string{"projection", "fields"} {
+		if v, ok := command[k]; ok { redacted[k] = redactProjection(v) }
+	}
+	// findAndModify's update document; the update command names its
+	// collection under the same key.
+	if u, ok := command["update"]; ok {
+		if _, isName := u.(string); !isName { redacted["update"] = redactValue(u) }
+	}
+	for _, k := range []string{"updates", "deletes", "ops"} {
+		statements, ok := command[k].([]interface{})
+		if !ok { continue }
+		var masked []interface{}
+		for _, s := range statements {
+			entry, ok := s.(map[string]interface{})
+			if !ok { continue }
+			copied := make(map[string]interface{}, len(entry))
+			for field, v := range entry { copied[field] = v }
+			for _, field := range []string{"q", "u", "arrayFilters", "filter", "updateMods", "document"} {
+				if v, ok := entry[field]; ok { copied[field] = redactValue(v) }
+			}
+			masked = append(masked, copied)
 		}
-		separator := ", "; if pretty { separator = ",\n" }
-		if pretty { return fmt.Sprintf("{\n%s\n%s}", strings.Join(parts, separator), closingIndent) }
-		return fmt.Sprintf("{ %s }", strings.Join(parts, separator))
+		redacted[k] = masked
+	}
+	return redacted
+}
+
+// keptStages are aggregation stages whose operands are sort orders, counts
+// or field names rather than data, and are left as they are.
+var keptStages = map[string]bool{
+	"$sort": true, "$limit": true, "$skip": true, "$sample": true,
+	"$count": true, "$unwind": true, "$unset": true, "$sortByCount": true,
+}
 
+// redactValue replaces string and number leaves with "<string>" and
+// "<number>" placeholders and type wrappers such as {"$oid": ...} with one
+// naming the type, e.g. "<oid>". Keys, booleans and null are kept, as are
+// strings starting with $, which are field paths and variables rather than
+// literals. The names a $lookup, $graphLookup or $unionWith stage reads from
+// are kept, as are the format and timezone of $dateToString; only their
+// nested documents are masked. $project keeps only its inclusion flags, and
+// JavaScript, a $function body or a $code wrapper, becomes "<code>".
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if _, ok := ejsonLiteral(v); ok {
+			if _, ok := v["$ref"]; ok { return "<dbref>" }
+			if _, ok := v["$code"]; ok { return redactedCode() }
+			for k := range v { return "<" + strings.TrimPrefix(k, "$") + ">" }
+		}
+		redacted := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			switch {
+			case keptStages[k], k == "$meta": // $meta names a keyword such as "textScore"
+				redacted[k] = child
+			case k == "$lookup" || k == "$graphLookup" || k == "$unionWith" || k == "$dateToString":
+				redacted[k] = redactStageNames(child)
+			case k == "$project":
+				redacted[k] = redactProjection(child)
+			case k == "$function":
+				redacted[k] = redactFunction(child)
+			default:
+				redacted[k] = redactValue(child)
+			}
+		}
+		return redacted
 	case []interface{}:
-		var parts []string; for _, item := range v { parts = append(parts, toShellFormat(item, pretty, level+1)) }
-		separator := ", "; if pretty { separator = ",\n" }
-		if pretty { return fmt.Sprintf("[\n%s%s\n%s]", indent, strings.Join(parts, separator+indent), closingIndent) }
-		return fmt.Sprintf("[%s]", strings.Join(parts, separator))
-	case string: return fmt.Sprintf(`"%s"`, v)
-	case nil: return "null"
-	default: return fmt.Sprintf("%v", v)
+		redacted := make([]interface{}, len(v))
+		for i, item := range v { redacted[i] = redactValue(item) }
+		return redacted
+	case string:
+		if strings.HasPrefix(v, "$") { return v }
+		return "<string>"
+	case json.Number:
+		return "<number>"
+	}
+	return v
+}
+
+// redactProjection masks a projection but for its inclusion and exclusion
+// flags, 0, 1, true and false, and the nested projections made of them.
+// Computed fields, such as a $cond or a $literal, are masked like any value.
+func redactProjection(projection interface{}) interface{} {
+	doc, ok := projection.(map[string]interface{})
+	if !ok { return redactValue(projection) }
+	redacted := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		switch v := v.(type) {
+		case bool:
+			redacted[k] = v
+		case json.Number:
+			if v == "0" || v == "1" { redacted[k] = v } else { redacted[k] = redactValue(v) }
+		case map[string]interface{}:
+			if hasOperatorKeys(v) { redacted[k] = redactValue(v) } else { redacted[k] = redactProjection(v) }
+		default:
+			redacted[k] = redactValue(v)
+		}
+	}
+	return redacted
+}
+
+// redactFunction masks the body of a $function expression as code and its
+// args like any value; lang is kept.
+func redactFunction(operand interface{}) interface{} {
+	doc, ok := operand.(map[string]interface{})
+	if !ok { return redactValue(operand) }
+	redacted := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		switch k {
+		case "body": redacted[k] = redactedCode()
+		case "lang": redacted[k] = v
+		default: redacted[k] = redactValue(v)
+		}
+	}
+	return redacted
+}
+
+// redactStageNames masks the operand of a stage that reads another
+// collection, keeping its top-level strings (from, as, localField, ...).
+func redactStageNames(operand interface{}) interface{} {
+	doc, ok := operand.(map[string]interface{})
+	if !ok { return operand } // {$unionWith: "coll"}
+	redacted := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		if _, isString := v.(string); isString { redacted[k] = v } else { redacted[k] = redactValue(v) }
+	}
+	return redacted
+}
+
+// -----------------------------------------------------------------------------
+// Output validation
+// -----------------------------------------------------------------------------
+
+// validateQuery checks that a rendered query is one well-formed shell
+// expression. Comment lines are skipped; the expression grammar covers what
+// l2q emits: member and call chains, documents, arrays, strings, numbers,
+// regex literals, constructor calls such as ObjectId() and raw functions.
+func validateQuery(query string) error {
+	p := &shellParser{src: query}
+	if err := p.expression(); err != nil { return err }
+	p.skipSpace()
+	if p.pos < len(p.src) { return p.errorf("unexpected %q after the expression", p.src[p.pos]) }
+	return nil
+}
+
+// shellParser is a small recursive-descent parser over the shell syntax l2q
+// produces. It only checks structure and builds no values.
+type shellParser struct {
+	src string
+	pos int
+}
+
+func (p *shellParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// skipSpace skips whitespace and both comment forms.
+func (p *shellParser) skipSpace() {
+	for p.pos < len(p.src) {
+		switch {
+		case strings.ContainsRune(" \t\r\n", rune(p.src[p.pos])):
+			p.pos++
+		case strings.HasPrefix(p.src[p.pos:], "//"):
+			if end := strings.IndexByte(p.src[p.pos:], '\n'); end >= 0 { p.pos += end } else { p.pos = len(p.src) }
+		case strings.HasPrefix(p.src[p.pos:], "/*"):
+			if end := strings.Index(p.src[p.pos+2:], "*/"); end >= 0 { p.pos += end + 4 } else { p.pos = len(p.src) }
+		default:
+			return
+		}
+	}
+}
+
+func (p *shellParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.src) { return p.src[p.pos] }
+	return 0
+}
+
+func (p *shellParser) expect(c byte) error {
+	if p.peek() != c { return p.errorf("expected %q", c) }
+	p.pos++
+	return nil
+}
+
+// expression parses a primary value followed by any .member and (args)
+// suffixes.
+func (p *shellParser) expression() error {
+	if err := p.primary(); err != nil { return err }
+	for {
+		switch p.peek() {
+		case '.':
+			p.pos++
+			if p.identifier() == "" { return p.errorf("expected a member name") }
+		case '(':
+			p.pos++
+			if err := p.list(')', p.expression); err != nil { return err }
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *shellParser) primary() error {
+	switch c := p.peek(); {
+	case c == '{':
+		p.pos++
+		return p.list('}', p.member)
+	case c == '[':
+		p.pos++
+		return p.list(']', p.expression)
+	case c == '"' || c == '\'':
+		return p.quoted()
+	case c == '/':
+		return p.regex()
+	case c == '-' || c >= '0' && c <= '9':
+		return p.number()
+	case c == '$' || c == '_' || unicode.IsLetter(rune(c)):
+		switch p.identifier() {
+		case "function":
+			return p.function()
+		case "new": // new Date(...) in legacy documents
+			return p.expression()
+		}
+		return nil
+	case c == 0:
+		return p.errorf("unexpected end of input")
+	default:
+		return p.errorf("unexpected %q", c)
+	}
+}
+
+// list parses comma-separated items up to the closing byte; a trailing comma
+// is accepted as the shell does.
+func (p *shellParser) list(closing byte, item func() error) error {
+	for {
+		if p.peek() == closing { p.pos++; return nil }
+		if err := item(); err != nil { return err }
+		if p.peek() == ',' { p.pos++; continue }
+		return p.expect(closing)
+	}
+}
+
+// member parses a document key, quoted or bare, and its value.
+func (p *shellParser) member() error {
+	if c := p.peek(); c == '"' || c == '\'' {
+		if err := p.quoted(); err != nil { return err }
+	} else if p.identifier() == "" {
+		return p.errorf("expected a key")
+	}
+	if err := p.expect(':'); err != nil { return err }
+	return p.expression()
+}
+
+func (p *shellParser) identifier() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := rune(p.src[p.pos])
+		if c != '$' && c != '_' && !unicode.IsLetter(c) && !unicode.IsDigit(c) { break }
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// quoted parses a single- or double-quoted string with backslash escapes.
+func (p *shellParser) quoted() error {
+	quote := p.src[p.pos]
+	for p.pos++; p.pos < len(p.src); p.pos++ {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos++
+		case '\n':
+			return p.errorf("newline in string")
+		case quote:
+			p.pos++
+			return nil
+		}
+	}
+	return p.errorf("unterminated string")
+}
+
+func (p *shellParser) regex() error {
+	for p.pos++; p.pos < len(p.src); p.pos++ {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos++
+		case '\n':
+			return p.errorf("newline in regex")
+		case '/':
+			return p.flags()
+		}
+	}
+	return p.errorf("unterminated regex")
+}
+
+// flags reads the flags after a regex literal. JavaScript rejects any
+// flag outside gimsuy, and a flag given twice.
+func (p *shellParser) flags() error {
+	seen := map[byte]bool{}
+	for p.pos++; p.pos < len(p.src); p.pos++ {
+		c := p.src[p.pos]
+		if c != '$' && c != '_' && !unicode.IsLetter(rune(c)) && !unicode.IsDigit(rune(c)) { break }
+		if !strings.ContainsRune("gimsuy", rune(c)) || seen[c] { return p.errorf("invalid regex flag %q", c) }
+		seen[c] = true
 	}
+	return nil
+}
+
+func (p *shellParser) number() error {
+	start := p.pos
+	if p.src[p.pos] == '-' { p.pos++ }
+	for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 { p.pos++ }
+	if _, err := strconv.ParseFloat(p.src[start:p.pos], 64); err != nil {
+		p.pos = start
+		return p.errorf("malformed number")
+	}
+	return nil
+}
+
+// function skips a function's parameter list and its body, which is treated
+// as opaque apart from balancing braces outside strings.
+func (p *shellParser) function() error {
+	p.identifier() // optional name
+	if err := p.expect('('); err != nil { return err }
+	if end := strings.IndexByte(p.src[p.pos:], ')'); end >= 0 { p.pos += end + 1 } else { return p.errorf("unterminated parameter list") }
+	if err := p.expect('{'); err != nil { return err }
+	for depth := 1; depth > 0; {
+		if p.pos >= len(p.src) { return p.errorf("unterminated function body") }
+		switch c := p.src[p.pos]; c {
+		case '"', '\'', '`':
+			if err := p.quoted(); err != nil { return err }
+			continue
+		case '{':
+			depth++
+		case '}':
+			depth--
+		}
+		p.pos++
+	}
+	return nil
 }
 
 // -----------------------------------------------------------------------------
@@ -125,68 +3393,263 @@ func toShellFormat(data interface{}, pretty bool, level int) string {
 
 func processLineLegacy(line []byte) {
 	logStr := string(line)
-	if strings.Contains(logStr, " command: aggregate ") {
-		handleLegacyAggregate(logStr)
-	} else if strings.Contains(logStr, " command: find ") {
-		handleLegacyFind(logStr)
+	explainVerbosity, depthWarned = "", false
+	if !inTimeWindow(legacyTimestamp(logStr)) { return }
+	op, commandStr := legacyCommand(logStr)
+	if config.ReplaceOIDs { commandStr = legacyObjectID.ReplaceAllLiteralString(commandStr, oidPlaceholder) }
+	switch {
+	case op == "":
+		if legacyCommandStart.MatchString(logStr) {
+			stats.unparsed++
+			if config.WarnTruncated { fmt.Fprintf(os.Stderr, "warning: truncated/unbalanced document at %s:%d\n", position.name, position.line) }
+		}
+	case extractStringValue(commandStr, "$db") == "":
+		stats.unparsed++
+	default:
+		stats.parsed++
+	}
+	if !opSelected(op) || config.Redact { return }
+	var database, collection, query string
+	var queries []string
+	switch op {
+	case "aggregate":
+		database, collection, query = handleLegacyAggregate(commandStr)
+	case "find":
+		database, collection, query = handleLegacyFind(commandStr)
+	case "update":
+		database, collection, queries = handleLegacyUpdate(commandStr)
+	case "delete":
+		database, collection, queries = handleLegacyDelete(commandStr)
+	}
+	if query != "" { queries = []string{query} }
+	if len(queries) == 0 || !nsSelected(database, collection, nil) { return }
+	if ms, ok := legacyDuration(logStr); ok { recordDuration(ms) }
+	entryDuration.ms, entryDuration.ok = legacyDuration(logStr)
+	for _, query := range queries {
+		if config.DocOnly {
+			emit(op, database, collection, query)
+			continue
+		}
+		if config.ShowWinningPlan {
+			if m := legacyPlanSummary.FindStringSubmatch(logStr); m != nil { query = fmt.Sprintf("// plan summary: %s\n%s", m[1], query) }
+		}
+		if config.ShowExecStats {
+			if line := legacyExecStats(logStr); line != "" { query = fmt.Sprintf("// %s\n%s", line, query) }
+		}
+		if config.Header {
+			ms, ok := legacyDuration(logStr)
+			query = queryHeader(database, collection, op, ms, ok) + query
+		}
+		emit(op, database, collection, query)
+	}
+}
+
+// legacyDurationToken matches the "NNNms" that ends a legacy slow query line.
+var legacyDurationToken = regexp.MustCompile(`\s(\d+)ms\s*$`)
+
+func legacyDuration(logStr string) (int64, bool) {
+	m := legacyDurationToken.FindStringSubmatch(logStr)
+	if m == nil { return 0, false }
+	ms, err := strconv.ParseInt(m[1], 10, 64)
+	return ms, err == nil
+}
+
+// legacyPlanSummary matches the planSummary token: a stage name, optionally
+// followed by the index key pattern.
+var legacyPlanSummary = regexp.MustCompile(`\bplanSummary: (\w+(?: \{[^}]*\})?)`)
+
+var legacyExecStat = regexp.MustCompile(`\b(keysExamined|docsExamined|nreturned|reslen):(\d+)`)
+
+// legacyExecStats formats the counters legacy lines log as key:value tokens
+// after the command document.
+func legacyExecStats(logStr string) string {
+	found := map[string]string{}
+	for _, m := range legacyExecStat.FindAllStringSubmatch(logStr, -1) { found[m[1]] = m[2] }
+	var parts []string
+	for _, field := range execStatFields {
+		if value, ok := found[field]; ok { parts = append(parts, fmt.Sprintf("%s: %s", field, value)) }
+	}
+	return strings.Join(parts, ", ")
+}
+
+// legacyTimestamp parses the ISO-8601 timestamp that starts a legacy log line,
+// e.g. 2019-03-01T12:34:56.789+0000.
+func legacyTimestamp(logStr string) (time.Time, bool) {
+	token := logStr
+	if i := strings.IndexByte(logStr, ' '); i != -1 { token = logStr[:i] }
+	for _, layout := range []string{"2006-01-02T15:04:05.000-0700", time.RFC3339Nano} {
+		if t, err := time.Parse(layout, token); err == nil { return t, true }
 	}
+	return time.Time{}, false
 }
 
-func handleLegacyAggregate(logStr string) {
-	cmdStart := strings.Index(logStr, "command: aggregate ")
-	if cmdStart == -1 { return }
-	objStart := strings.Index(logStr[cmdStart:], "{")
-	if objStart == -1 { return }
-	objStart += cmdStart
+// legacyCommandStart matches the "command: <name> {" that introduces the
+// logged command. It must follow whitespace, so keys that merely end in
+// "command", such as originatingCommand, don't match.
+var legacyCommandStart = regexp.MustCompile(`(?:^|\s)command: (\w+) \{`)
 
+// legacyCommand returns the name and document of the command a legacy line
+// logs. Only the first match outside a string literal counts: a later one
+// sits inside that document, for instance in a comment.
+func legacyCommand(logStr string) (op, commandStr string) {
+	var m []int
+	for _, loc := range legacyCommandStart.FindAllStringSubmatchIndex(logStr, -1) {
+		if !insideString(logStr, loc[0]) { m = loc; break }
+	}
+	if m == nil { return "", "" }
+	objStart := m[1] - 1
 	objEnd := findMatchingBrace(logStr, objStart)
-	if objEnd == -1 { return }
-	commandStr := logStr[objStart : objEnd+1]
+	if objEnd == -1 { return "", "" }
+	return logStr[m[2]:m[3]], quoteDottedKeys(logStr[objStart : objEnd+1])
+}
+
+// insideString reports whether offset i of a legacy line falls inside a
+// string literal, such as an appName quoting "command: aggregate {".
+func insideString(logStr string, i int) bool {
+	if !strings.Contains(logStr[:i], `"`) { return false }
+	for _, loc := range stringLiteral.FindAllStringIndex(logStr, -1) {
+		if loc[0] >= i { return false }
+		if i < loc[1] { return true }
+	}
+	return false
+}
+
+// legacyDottedKey matches an unquoted dotted-path key such as a.b.c or
+// items.$[] in a legacy document.
+var legacyDottedKey = regexp.MustCompile(`([{,]\s*)([A-Za-z_$][\w$]*(?:\.[\w$\[\]]+)+):`)
+
+// quoteDottedKeys quotes the dotted-path keys of a legacy document. Legacy
+// logs print keys bare, and a.b: 1 is not valid shell syntax, so {$set:
+// {a.b: 1}} would not paste. String values are copied through untouched.
+func quoteDottedKeys(doc string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range stringLiteral.FindAllStringIndex(doc, -1) {
+		b.WriteString(legacyDottedKey.ReplaceAllString(doc[last:loc[0]], `$1"$2":`))
+		b.WriteString(doc[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(legacyDottedKey.ReplaceAllString(doc[last:], `$1"$2":`))
+	return b.String()
+}
 
-	collection := extractStringValue(commandStr, "aggregate")
-	database := extractStringValue(commandStr, "$db")
+var legacyWriteStage = regexp.MustCompile(`[{,]\s*(\$out|\$merge):`)
+
+func handleLegacyAggregate(commandStr string) (database, collection, query string) {
+	collection = extractStringValue(commandStr, "aggregate")
+	database = extractStringValue(commandStr, "$db")
 	if collection == "" || database == "" { return }
 
 	pipelineStr, ok := extractObject(commandStr, "pipeline")
 	if !ok { return }
+	if config.DocOnly { return database, collection, pipelineStr }
 
-	query := fmt.Sprintf("db.getSiblingDB('%s').%s.aggregate(%s)", database, collection, pipelineStr)
-	fmt.Println(query + ".explain()")
-	fmt.Println("---")
+	query = fmt.Sprintf("%s.aggregate(%s)", explainTarget(database, collection), pipelineStr)
+	if config.NoExplain && config.InjectMaxTimeMS > 0 { query = strings.TrimSuffix(query, ")") + fmt.Sprintf(", { maxTimeMS: %d })", config.InjectMaxTimeMS) }
+	if m := legacyWriteStage.FindStringSubmatch(commandStr); m != nil { query = writeStageWarning(m[1]) + query }
+	return database, collection, query + explainSuffix()
 }
 
-func handleLegacyFind(logStr string) {
-	cmdStart := strings.Index(logStr, "command: find ")
-	if cmdStart == -1 { return }
-	objStart := strings.Index(logStr[cmdStart:], "{")
-	if objStart == -1 { return }
-	objStart += cmdStart
-
-	objEnd := findMatchingBrace(logStr, objStart)
-	if objEnd == -1 { return }
-	commandStr := logStr[objStart : objEnd+1]
+// legacySortDirection matches a fractional-looking integer direction such as
+// the 1.0 older servers print, so the sort renders as 1/-1 like JSON logs.
+var legacySortDirection = regexp.MustCompile(`(:\s*-?\d+)\.0+\b`)
 
-	collection := extractStringValue(commandStr, "find")
-	database := extractStringValue(commandStr, "$db")
+func handleLegacyFind(commandStr string) (database, collection, query string) {
+	collection = extractStringValue(commandStr, "find")
+	database = extractStringValue(commandStr, "$db")
 	if collection == "" || database == "" { return }
 
 	filterStr, ok := extractObject(commandStr, "filter")
 	if !ok { filterStr = "{}" }
 
+	if config.DocOnly { return database, collection, filterStr }
+
 	projectionStr, hasProjection := extractObject(commandStr, "projection")
+	// Some drivers log the projection under the OP_QUERY name "fields".
+	if !hasProjection { projectionStr, hasProjection = extractObject(commandStr, "fields") }
 	sortStr, hasSort := extractObject(commandStr, "sort")
 	limitStr, hasLimit := extractNumericValue(commandStr, "limit")
 	skipStr, hasSkip := extractNumericValue(commandStr, "skip")
 
-	query := fmt.Sprintf("db.getSiblingDB('%s').%s.find(%s", database, collection, filterStr)
+	query = fmt.Sprintf("%s.find(%s", explainTarget(database, collection), filterStr)
 	if hasProjection { query += ", " + projectionStr }
 	query += ")"
-	if hasSort { query += fmt.Sprintf(".sort(%s)", sortStr) }
+	if hasSort { query += fmt.Sprintf(".sort(%s)", legacySortDirection.ReplaceAllString(sortStr, "$1")) }
+	// A hint is logged as an index name or a key pattern.
+	if hintStr, ok := extractObject(commandStr, "hint"); ok {
+		query += fmt.Sprintf(".hint(%s)", hintStr)
+	} else if hintName := extractStringValue(commandStr, "hint"); hintName != "" {
+		query += fmt.Sprintf(".hint(%s)", quoteString(hintName))
+	}
 	if hasSkip { query += fmt.Sprintf(".skip(%s)", skipStr) }
 	if hasLimit { query += fmt.Sprintf(".limit(%s)", limitStr) }
+	if config.NoExplain && config.InjectMaxTimeMS > 0 { query += fmt.Sprintf(".maxTimeMS(%d)", config.InjectMaxTimeMS) }
+
+	return database, collection, query + explainSuffix()
+}
+
+// legacyOperatorDocument matches an update document whose first key is an
+// update operator, telling it apart from a replacement document.
+var legacyOperatorDocument = regexp.MustCompile(`^\{\s*\$`)
+
+func handleLegacyUpdate(commandStr string) (database, collection string, queries []string) {
+	collection = extractStringValue(commandStr, "update")
+	database = extractStringValue(commandStr, "$db")
+	if collection == "" || database == "" { return }
+	updates, ok := extractObject(commandStr, "updates")
+	if !ok { return }
+	writeConcern, hasWriteConcern := extractObject(commandStr, "writeConcern")
+
+	for _, entry := range legacyArrayDocuments(updates) {
+		q, ok := extractObject(entry, "q")
+		if !ok { continue }
+		u, ok := extractObject(entry, "u")
+		if !ok { continue }
+		if config.DocOnly {
+			queries = append(queries, q)
+			continue
+		}
+		multi := extractBoolValue(entry, "multi")
+		var options []string
+		if config.UpdateStyle == "legacy" && multi { options = append(options, "multi: true") }
+		if extractBoolValue(entry, "upsert") { options = append(options, "upsert: true") }
+		if af, ok := extractObject(entry, "arrayFilters"); ok { options = append(options, "arrayFilters: "+af) }
+		if hasWriteConcern { options = append(options, "writeConcern: "+writeConcern) }
+
+		replacement := !strings.HasPrefix(u, "[") && !legacyOperatorDocument.MatchString(u)
+		query := fmt.Sprintf("%s.%s(%s, %s", collectionRef(database, collection), updateMethod(replacement, multi), q, u)
+		if len(options) > 0 { query += fmt.Sprintf(", { %s }", strings.Join(options, ", ")) }
+		if strings.HasPrefix(u, "[") { query = "// update with an aggregation pipeline\n" + query }
+		queries = append(queries, query+")")
+	}
+	return database, collection, queries
+}
+
+func handleLegacyDelete(commandStr string) (database, collection string, queries []string) {
+	collection = extractStringValue(commandStr, "delete")
+	database = extractStringValue(commandStr, "$db")
+	if collection == "" || database == "" { return }
+	deletes, ok := extractObject(commandStr, "deletes")
+	if !ok { return }
+	writeConcern, hasWriteConcern := extractObject(commandStr, "writeConcern")
 
-	fmt.Println(query + ".explain()")
-	fmt.Println("---")
+	for _, entry := range legacyArrayDocuments(deletes) {
+		q, ok := extractObject(entry, "q")
+		if !ok { continue }
+		if config.DocOnly {
+			queries = append(queries, q)
+			continue
+		}
+		limit, _ := extractNumericValue(entry, "limit")
+		justOne := limit == "1"
+		query := fmt.Sprintf("%s.%s(%s", collectionRef(database, collection), deleteMethod(justOne), q)
+		var options []string
+		if justOne && config.UpdateStyle == "legacy" { options = append(options, "justOne: true") }
+		if hasWriteConcern { options = append(options, "writeConcern: "+writeConcern) }
+		if len(options) > 0 { query += fmt.Sprintf(", { %s }", strings.Join(options, ", ")) }
+		queries = append(queries, query+")")
+	}
+	return database, collection, queries
 }
 
 // -----------------------------------------------------------------------------
@@ -206,30 +3669,68 @@ func findMatchingBrace(s string, startPos int) int {
 	return -1
 }
 
+// extractObject returns the document or array value of key. The key must
+// start a field (follow '{', ',' or a space) and its value must open right
+// after the colon, so another field's value is never picked up instead. A
+// match with a scalar value, such as a nested u: 5, is skipped for the next.
 func extractObject(s, key string) (string, bool) {
-	keyStart := strings.Index(s, key+":")
-	if keyStart == -1 { return "", false }
-	objStart := strings.Index(s[keyStart:], "{")
-	if objStart == -1 {
-		objStart = strings.Index(s[keyStart:], "[")
-		if objStart == -1 { return "", false }
+	for from := 0; ; {
+		i := strings.Index(s[from:], key+": ")
+		if i == -1 { return "", false }
+		i += from; from = i + 1
+		if i > 0 && !strings.ContainsRune("{, ", rune(s[i-1])) { continue }
+		objStart := i + len(key) + 2
+		if objStart >= len(s) || s[objStart] != '{' && s[objStart] != '[' { continue }
+		objEnd := findMatchingBrace(s, objStart)
+		if objEnd == -1 { return "", false }
+		return s[objStart : objEnd+1], true
+	}
+}
+
+// legacyArrayDocuments returns the documents that are elements of a logged
+// array, skipping any other elements.
+func legacyArrayDocuments(array string) []string {
+	var docs []string
+	for i := 1; i < len(array)-1; i++ {
+		if array[i] != '{' { continue }
+		end := findMatchingBrace(array, i)
+		if end == -1 { break }
+		docs = append(docs, array[i:end+1])
+		i = end
+	}
+	return docs
+}
+
+func extractBoolValue(s, key string) bool {
+	return strings.Contains(s, " "+key+": true")
+}
+
+// valuePatterns caches the compiled patterns of extractStringValue and
+// extractNumericValue by pattern text; the handful of keys they look up would
+// otherwise be compiled again for every line.
+var valuePatterns = map[string]*regexp.Regexp{}
+
+// valuePattern returns the compiled pattern for key followed by suffix.
+func valuePattern(key, suffix string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(key) + suffix
+	re, ok := valuePatterns[expr]
+	if !ok {
+		re = regexp.MustCompile(expr)
+		valuePatterns[expr] = re
 	}
-	objStart += keyStart
-	objEnd := findMatchingBrace(s, objStart)
-	if objEnd == -1 { return "", false }
-	return s[objStart : objEnd+1], true
+	return re
 }
 
 func extractStringValue(s, key string) string {
-	re := regexp.MustCompile(regexp.QuoteMeta(key) + `: "([^"]+)"`)
-	matches := re.FindStringSubmatch(s)
+	matches := valuePattern(key, `: "([^"]+)"`).FindStringSubmatch(s)
 	if len(matches) < 2 { return "" }
 	return matches[1]
 }
 
+// extractNumericValue returns the integer logged after key, unwrapping the
+// NumberLong(50) and NumberInt(50) constructors legacy logs often print.
 func extractNumericValue(s, key string) (string, bool) {
-	re := regexp.MustCompile(regexp.QuoteMeta(key) + `: (\d+)`)
-	matches := re.FindStringSubmatch(s)
+	matches := valuePattern(key, `: (?:Number(?:Long|Int)\("?)?(\d+)`).FindStringSubmatch(s)
 	if len(matches) < 2 { return "", false }
 	return matches[1], true
 }
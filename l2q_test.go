@@ -0,0 +1,902 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// run converts input with cfg and returns the output.
+func run(t *testing.T, cfg Config, input string) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := convert(cfg, strings.NewReader(input), &b); err != nil { t.Fatalf("convert: %v", err) }
+	return b.String()
+}
+
+// findEntry is a JSON slow query entry for a find on shop.orders.
+const findEntry = `{"t":{"$date":"2024-10-01T10:00:00.000+00:00"},"msg":"Slow query","attr":{"ns":"shop.orders","command":{"find":"orders","filter":{"status":"A"},"$db":"shop"},"durationMillis":150}}`
+
+// TestConvertResetsState runs the same buffered conversion twice: nothing
+// from the first run may leak into the second.
+func TestConvertResetsState(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.GroupByNS, cfg.EmitGetIndexes = true, true
+	first := run(t, cfg, findEntry)
+	if second := run(t, cfg, findEntry); second != first { t.Errorf("second run differs:\n%s\nfirst:\n%s", second, first) }
+	if n := strings.Count(first, "getIndexes()"); n != 1 { t.Errorf("got %d getIndexes() calls, want 1:\n%s", n, first) }
+}
+
+func TestConvertValidates(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UpdateStyle = "classic"
+	if err := convert(cfg, strings.NewReader(findEntry), io.Discard); err == nil { t.Error("convert accepted -update-style classic") }
+}
+
+// legacyLines is a legacy-format log of the commands the legacy parser
+// handles, used to measure it.
+var legacyLines = [][]byte{
+	[]byte(`2019-03-01T12:34:56.789+0000 I COMMAND  [conn1] command shop.orders command: find { find: "orders", filter: { status: "A" }, projection: { item: 1 }, sort: { qty: -1 }, limit: 10, skip: 2, $db: "shop" } planSummary: COLLSCAN keysExamined:0 docsExamined:1000 numYields:0 nreturned:10 reslen:500 locks:{} protocol:op_msg 120ms`),
+	[]byte(`2019-03-01T12:35:56.789+0000 I COMMAND  [conn2] command shop.orders command: aggregate { aggregate: "orders", pipeline: [ { $match: { status: "A" } } ], cursor: {}, $db: "shop" } planSummary: COLLSCAN 300ms`),
+	[]byte(`2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command shop.orders command: update { update: "orders", updates: [ { q: { sku: "x" }, u: { $set: { qty: 1 } }, multi: true } ], $db: "shop" } 150ms`),
+}
+
+// TestValuePatternCache checks that cached patterns extract the same values
+// as freshly compiled ones.
+func TestValuePatternCache(t *testing.T) {
+	line := string(legacyLines[0])
+	for i := 0; i < 2; i++ {
+		if got := extractStringValue(line, "find"); got != "orders" { t.Fatalf("pass %d: find = %q, want orders", i, got) }
+		if got, ok := extractNumericValue(line, "limit"); !ok || got != "10" { t.Fatalf("pass %d: limit = %q, %v, want 10", i, got, ok) }
+		if _, ok := extractNumericValue(line, "batchSize"); ok { t.Fatalf("pass %d: batchSize found in a line without one", i) }
+	}
+	if n := len(valuePatterns); n == 0 { t.Fatal("no patterns were cached") }
+}
+
+func benchmarkLegacy(b *testing.B, cached bool) {
+	defer func(w io.Writer) { output = w }(output)
+	output = io.Discard
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if !cached { valuePatterns = map[string]*regexp.Regexp{} }
+		for _, line := range legacyLines { processLine(line) }
+	}
+}
+
+// BenchmarkProcessLineLegacy converts legacy lines with the pattern cache;
+// BenchmarkProcessLineLegacyUncached empties it before every pass, compiling
+// each pattern again as before the cache was added.
+func BenchmarkProcessLineLegacy(b *testing.B)         { benchmarkLegacy(b, true) }
+func BenchmarkProcessLineLegacyUncached(b *testing.B) { benchmarkLegacy(b, false) }
+
+
+// entry wraps a command into a JSON slow query entry on namespace ns.
+func entry(ns, command string) string {
+	return `{"t":{"$date":"2024-10-01T10:00:00.000+00:00"},"msg":"Slow query","attr":{"ns":"` + ns + `","command":` + command + `,"durationMillis":150}}`
+}
+
+// contains fails the test unless got contains each of want.
+func contains(t *testing.T, got string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		if !strings.Contains(got, w) { t.Errorf("output lacks %q:\n%s", w, got) }
+	}
+}
+
+// TestSortOrder checks that sort documents keep the order of their fields,
+// which is part of what they mean, and that directions logged as 1.0 render
+// as integers.
+func TestSortOrder(t *testing.T) {
+	tests := []struct{ name, command, want string }{
+		{"find", `{"find":"c","filter":{},"sort":{"lastName":1,"firstName":1.0},"$db":"s"}`, `.sort({ "lastName": 1, "firstName": 1 })`},
+		{"tiebreaker", `{"find":"c","filter":{},"sort":{"createdAt":-1,"_id":-1},"$db":"s"}`, `.sort({ "createdAt": -1, "_id": -1 })`},
+		{"$sort stage", `{"aggregate":"c","pipeline":[{"$sort":{"lastName":1,"firstName":1}}],"cursor":{},"$db":"s"}`, `"$sort": {
+      "lastName": 1,
+      "firstName": 1
+    }`},
+		{"findAndModify", `{"findAndModify":"c","query":{},"sort":{"z":1,"a":-1},"remove":true,"$db":"s"}`, `"sort": { "z": 1, "a": -1 }`},
+		{"hint", `{"find":"c","filter":{},"hint":{"z":1,"a":-1},"$db":"s"}`, `.hint({ "z": 1, "a": -1 })`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { contains(t, run(t, defaultConfig(), entry("s.c", tt.command)), tt.want) })
+	}
+}
+
+func TestSortOrderIndexSuggestion(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.IndexSuggestion = true
+	got := run(t, cfg, entry("s.c", `{"find":"c","filter":{"a":1},"sort":{"lastName":1,"firstName":1.0},"$db":"s"}`))
+	contains(t, got, `createIndex({ "a": 1, "lastName": 1, "firstName": 1 })`)
+}
+
+// TestProjectionIDFirst checks that _id leads a projection, where moving it
+// is harmless, but stays in place in a sort, where it is a tiebreaker.
+func TestProjectionIDFirst(t *testing.T) {
+	got := run(t, defaultConfig(), entry("s.c", `{"find":"c","filter":{},"projection":{"Name":1,"_id":0},"sort":{"createdAt":-1,"_id":-1},"$db":"s"}`))
+	contains(t, got, "{\n  \"_id\": 0,\n  \"Name\": 1\n}", `.sort({ "createdAt": -1, "_id": -1 })`)
+	got = run(t, defaultConfig(), entry("s.c", `{"aggregate":"c","pipeline":[{"$project":{"Name":1,"_id":0}}],"cursor":{},"$db":"s"}`))
+	contains(t, got, "\"$project\": {\n      \"_id\": 0,\n      \"Name\": 1")
+}
+
+// bulkWriteCommand writes to s.c and t.d in one command run on admin.
+const bulkWriteCommand = `{"bulkWrite":1,"ops":[{"insert":0,"document":{"_id":1}},{"update":1,"filter":{"q":1},"updateMods":{"$set":{"x":1}},"multi":true},{"delete":0,"filter":{"_id":2},"multi":false}],"nsInfo":[{"ns":"s.c"},{"ns":"t.d"}],"$db":"admin"}`
+
+// TestBulkWriteNamespaces checks that each bulkWrite op is filed under the
+// namespace it writes to, not the first of nsInfo.
+func TestBulkWriteNamespaces(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify, cfg.GroupByNS, cfg.Header = true, true, true
+	got := run(t, cfg, entry("admin.$cmd", bulkWriteCommand))
+	want := "// === s.c ===\n" +
+		"// s.c bulkWrite (150ms)\ndb.getSiblingDB('s').c.insertOne({\"_id\":1})\n---\n" +
+		"// s.c bulkWrite (150ms)\ndb.getSiblingDB('s').c.deleteOne({\"_id\":2})\n---\n" +
+		"// === t.d ===\n" +
+		"// t.d bulkWrite (150ms)\ndb.getSiblingDB('t').d.updateMany({\"q\":1},{\"$set\":{\"x\":1}})\n---\n"
+	if got != want { t.Errorf("got:\n%s\nwant:\n%s", got, want) }
+
+	cfg = defaultConfig()
+	cfg.CountOnly = true
+	contains(t, run(t, cfg, entry("admin.$cmd", bulkWriteCommand)), "s.c        bulkWrite  2", "t.d        bulkWrite  1")
+
+	cfg = defaultConfig()
+	cfg.NamespaceGlob = "t.*"
+	got = run(t, cfg, entry("admin.$cmd", bulkWriteCommand))
+	if strings.Contains(got, "getSiblingDB('s')") || !strings.Contains(got, "getSiblingDB('t').d.updateMany(") { t.Errorf("-ns t.* selected the wrong ops:\n%s", got) }
+}
+
+// TestLegacyUpdateShortKeys checks that a nested field named like the q or u
+// of an update statement doesn't hide the statement's own.
+func TestLegacyUpdateShortKeys(t *testing.T) {
+	line := `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command shop.orders command: update { update: "orders", updates: [ { q: { u: 5 }, u: { $set: { qty: 1 } } } ], $db: "shop" } 150ms`
+	contains(t, run(t, defaultConfig(), line), "db.getSiblingDB('shop').orders.updateOne({ u: 5 }, { $set: { qty: 1 } })")
+}
+
+// TestCodeRendering checks that function expressions are written raw and
+// any other code, such as a $where predicate, as a string, keeping the
+// output valid shell.
+func TestCodeRendering(t *testing.T) {
+	tests := []struct{ name, filter, want string }{
+		{"$where predicate", `{"$where":{"$code":"this.a == 1 && this.b > 2"}}`, `"$where": "this.a == 1 && this.b > 2"`},
+		{"$where function", `{"$where":{"$code":"function() { return this.a == 1 }"}}`, `"$where": function() { return this.a == 1 }`},
+		{"named function", `{"$where":{"$code":"function check(){ return true }"}}`, `"$where": function check(){ return true }`},
+		{"function call", `{"$where":{"$code":"functionOf(this)"}}`, `"$where": "functionOf(this)"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := run(t, defaultConfig(), entry("s.c", `{"find":"c","filter":`+tt.filter+`,"$db":"s"}`))
+			contains(t, got, tt.want)
+			query := strings.TrimSuffix(got, "---\n")
+			if err := validateQuery(strings.TrimSpace(query)); err != nil { t.Errorf("invalid shell: %v\n%s", err, query) }
+		})
+	}
+}
+
+// TestWriteConcern checks that every kind of write keeps the command's
+// writeConcern.
+func TestWriteConcern(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	wc := `"writeConcern":{"w":"majority"}`
+	tests := []struct{ name, input, want string }{
+		{"update", entry("s.c", `{"update":"c","updates":[{"q":{"a":1},"u":{"$set":{"b":1}}}],`+wc+`,"$db":"s"}`), `{"$set":{"b":1}},{"writeConcern":{"w":"majority"}}`},
+		{"delete", entry("s.c", `{"delete":"c","deletes":[{"q":{"a":1},"limit":1}],`+wc+`,"$db":"s"}`), `deleteOne({"a":1},{"writeConcern":{"w":"majority"}})`},
+		{"bulkWrite insert", entry("admin.$cmd", `{"bulkWrite":1,"ops":[{"insert":0,"document":{"_id":1}}],"nsInfo":[{"ns":"s.c"}],`+wc+`,"$db":"admin"}`), `insertOne({"_id":1},{"writeConcern":{"w":"majority"}})`},
+		{"legacy update", `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command s.c command: update { update: "c", updates: [ { q: { a: 1 }, u: { $set: { b: 1 } } } ], writeConcern: { w: "majority" }, $db: "s" } 150ms`, `updateOne({ a: 1 }, { $set: { b: 1 } }, { writeConcern: { w: "majority" } })`},
+		{"legacy delete", `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command s.c command: delete { delete: "c", deletes: [ { q: { a: 1 }, limit: 0 } ], writeConcern: { w: "majority" }, $db: "s" } 150ms`, `deleteMany({ a: 1 }, { writeConcern: { w: "majority" } })`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { contains(t, run(t, cfg, tt.input), tt.want) })
+	}
+}
+
+// TestRegexLiteral checks that slashes are escaped and that options
+// JavaScript has no flag for fall back to a form the shell can run.
+func TestRegexLiteral(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.CollapseRegex, cfg.Minify = true, true
+	tests := []struct{ name, filter, want string }{
+		{"slash", `{"a":{"$regularExpression":{"pattern":"a/b","options":""}}}`, `{"a":/a\/b/}`},
+		{"i", `{"a":{"$regularExpression":{"pattern":"a/b","options":"i"}}}`, `{"a":/a\/b/i}`},
+		{"x", `{"a":{"$regularExpression":{"pattern":"a/b","options":"x"}}}`, `{"a":BSONRegExp("a/b", "x")}`},
+		{"operator i", `{"a":{"$regex":"a/b","$options":"i"}}`, `{"a":/a\/b/i}`},
+		{"operator x", `{"a":{"$regex":"a b","$options":"ix"}}`, `{"a":{"$options":"ix","$regex":"a b"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := run(t, cfg, entry("s.c", `{"find":"c","filter":`+tt.filter+`,"$db":"s"}`))
+			contains(t, got, "db.getSiblingDB('s').c.find("+tt.want+")")
+			if err := validateQuery(strings.TrimSpace(strings.TrimSuffix(got, "---\n"))); err != nil { t.Errorf("invalid shell: %v\n%s", err, got) }
+		})
+	}
+}
+
+func TestValidateRegexFlags(t *testing.T) {
+	for query, valid := range map[string]bool{"/a/gimsuy": true, "/a/": true, "/a/x": false, "/a/ii": false} {
+		if err := validateQuery(query); (err == nil) != valid { t.Errorf("validateQuery(%s) = %v, want valid %v", query, err, valid) }
+	}
+}
+
+// TestRedactCommentAndScope checks that -redact masks the comment and a
+// mapReduce's scope, which hold user data like the filter does.
+func TestRedactCommentAndScope(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Redact, cfg.Minify = true, true
+	got := run(t, cfg, entry("s.c", `{"find":"c","filter":{"name":"bob"},"comment":"lookup for bob@x.com","$db":"s"}`))
+	contains(t, got, `.comment("<string>")`)
+	got += run(t, cfg, entry("s.c", `{"find":"c","filter":{},"comment":{"user":"bob@x.com"},"$db":"s"}`))
+	got += run(t, cfg, entry("s.c", `{"mapReduce":"c","map":"function() { emit(this.k, secret) }","reduce":"function(k, v) { return v }","scope":{"secret":"s3cr3t"},"out":{"inline":1},"$db":"s"}`))
+	contains(t, got, `// comment: {"user":"<string>"}`, `"scope":{"secret":"<string>"}`)
+	for _, leak := range []string{"bob", "s3cr3t"} {
+		if strings.Contains(got, leak) { t.Errorf("output leaks %q:\n%s", leak, got) }
+	}
+}
+
+// TestRedactCodeAndProjection checks that -redact masks JavaScript, the
+// mapReduce functions, a $function body and $where code, as "<code>", and
+// keeps only the inclusion flags of a projection.
+func TestRedactCodeAndProjection(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Redact, cfg.Minify = true, true
+	got := run(t, cfg, entry("s.c", `{"mapReduce":"c","map":"function() { if (this.k == \"acme\") emit(this.k, 1) }","reduce":{"$code":"function(k, v) { return v.length + 42 }"},"finalize":"function(k, v) { return v * 7 }","out":{"inline":1},"$db":"s"}`))
+	contains(t, got, "mapReduce(\"<code>\",\"<code>\",{\"finalize\":\"<code>\",")
+	got += run(t, cfg, entry("s.c", `{"aggregate":"c","pipeline":[{"$project":{"a":1,"_id":0,"b":true,"s":{"$cond":[{"$eq":["$ssn","123-45-6789"]},"x","y"]},"l":{"$literal":"secret"},"n":{"x":1,"y":{"$literal":55}}}},{"$addFields":{"f":{"$function":{"body":"function(a) { return a == 99 }","args":["$a"],"lang":"js"}}}}],"cursor":{},"$db":"s"}`))
+	contains(t, got, `{"$project":{"_id":0,"a":1,"b":true,"l":{"$literal":"<string>"},"n":{"x":1,"y":{"$literal":"<number>"}},"s":{"$cond":[{"$eq":["$ssn","<string>"]},"<string>","<string>"]}}}`, `{"$function":{"args":["$a"],"body":"<code>","lang":"js"}}`)
+	got += run(t, cfg, entry("s.c", `{"find":"c","filter":{"$where":{"$code":"this.a == 77"}},"projection":{"a":1,"l":{"$literal":"secret"}},"$db":"s"}`))
+	contains(t, got, "{\"$where\":\"<code>\"},{\"a\":1,\"l\":{\"$literal\":\"<string>\"}}")
+	for _, leak := range []string{"acme", "42", "7 }", "123-45-6789", "secret", "55", "99", "77"} {
+		if strings.Contains(got, leak) { t.Errorf("output leaks %q:\n%s", leak, got) }
+	}
+	if err := validateQuery(strings.TrimSpace(strings.Split(got, "---\n")[0])); err != nil { t.Errorf("invalid shell: %v\n%s", err, got) }
+}
+
+// TestSplitDirModes checks that -group-by-ns output lands in the -split-dir
+// files, which are the groups, and that -script is refused with -split-dir.
+func TestSplitDirModes(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.GroupByNS, cfg.SplitDir = true, t.TempDir()
+	if got := run(t, cfg, findEntry+"\n"+entry("s.c", `{"find":"c","filter":{},"$db":"s"}`)); got != "" { t.Errorf("stdout got %q, want nothing", got) }
+	for _, name := range []string{"shop.orders.js", "s.c.js"} {
+		data, err := os.ReadFile(filepath.Join(cfg.SplitDir, name))
+		if err != nil || !strings.Contains(string(data), ".find(") { t.Errorf("%s: %q, %v", name, data, err) }
+	}
+	cfg.GroupByNS, cfg.Script = false, true
+	if err := convert(cfg, strings.NewReader(findEntry), io.Discard); err == nil { t.Error("convert accepted -script with -split-dir") }
+}
+
+// stderrOf returns what f writes to stderr.
+func stderrOf(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil { t.Fatal(err) }
+	saved := os.Stderr
+	os.Stderr = w
+	f()
+	os.Stderr = saved
+	w.Close()
+	data, _ := io.ReadAll(r)
+	return string(data)
+}
+
+// TestFollowWarningPosition checks that -warn-truncated names the followed
+// file; -limit stops the follow once the query after the damaged line is out.
+func TestFollowWarningPosition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mongod.log")
+	log := `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command shop.orders command: find { find: "orders", filter: { a: 1 ...` + "\n" + findEntry + "\n"
+	if err := os.WriteFile(path, []byte(log), 0o644); err != nil { t.Fatal(err) }
+	cfg := defaultConfig()
+	cfg.WarnTruncated, cfg.Limit = true, 1
+	if err := convert(cfg, strings.NewReader(""), io.Discard); err != nil { t.Fatal(err) }
+	got := stderrOf(t, func() {
+		if err := followFile(path); err != nil { t.Error(err) }
+	})
+	contains(t, got, "at "+path+":1\n")
+}
+
+// TestElemMatchRange checks that the range operators of an $elemMatch
+// render with the lower bound first, however they were logged, and that the
+// legacy path keeps the logged document.
+func TestElemMatchRange(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	for _, filter := range []string{`{"arr":{"$elemMatch":{"$gte":1,"$lt":5}}}`, `{"arr":{"$elemMatch":{"$lt":5,"$gte":1}}}`} {
+		got := run(t, cfg, entry("s.c", `{"find":"c","filter":`+filter+`,"$db":"s"}`))
+		contains(t, got, "db.getSiblingDB('s').c.find({\"arr\":{\"$elemMatch\":{\"$gte\":1,\"$lt\":5}}}).explain()")
+	}
+	got := run(t, cfg, entry("s.c", `{"find":"c","filter":{"items":{"$elemMatch":{"qty":{"$gt":2,"$lte":9},"sku":"a"}}},"$db":"s"}`))
+	contains(t, got, `{"items":{"$elemMatch":{"qty":{"$gt":2,"$lte":9},"sku":"a"}}}`)
+	line := `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command s.c command: find { find: "c", filter: { arr: { $elemMatch: { $gte: 1, $lt: 5 } } }, $db: "s" } 150ms`
+	contains(t, run(t, cfg, line), "db.getSiblingDB('s').c.find({ arr: { $elemMatch: { $gte: 1, $lt: 5 } } }).explain()")
+}
+
+// TestExplainWrappedFind checks that an explain-wrapped find without attr.ns
+// takes its namespace from the outer $db and keeps the logged verbosity.
+func TestExplainWrappedFind(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	line := `{"t":{"$date":"2024-01-01T00:00:00.000Z"},"msg":"Slow query","attr":{"command":{"explain":{"find":"c","filter":{"a":1}},"verbosity":"executionStats","$db":"s"},"durationMillis":150}}`
+	got := run(t, cfg, line)
+	contains(t, got, "db.getSiblingDB('s').c.find({\"a\":1}).explain(\"executionStats\")")
+	cfg.ExplainPrefix = true
+	contains(t, run(t, cfg, line), "db.getSiblingDB('s').c.explain(\"executionStats\").find(")
+	cfg.ExplainPrefix = false
+	plain := run(t, cfg, line+"\n"+entry("s.c", `{"find":"c","filter":{"b":1},"$db":"s"}`))
+	contains(t, plain, "{\"b\":1}).explain()")
+	var b bytes.Buffer
+	if err := convert(cfg, strings.NewReader(line), &b); err != nil { t.Fatal(err) }
+	if stats.parsed != 1 || stats.unparsed != 0 { t.Errorf("parsed %d, unparsed %d; want 1, 0", stats.parsed, stats.unparsed) }
+}
+
+// TestDeepAnd checks that a 1000-level $and converts without overflowing:
+// JSON input is cut at the default -max-depth with one warning, legacy input
+// is copied as logged, and a -max-depth the user gives, below or above the
+// default or 0 for unlimited, is honoured without a warning.
+func TestDeepAnd(t *testing.T) {
+	const levels = 1000
+	filter := strings.Repeat(`{"$and":[`, levels) + `{"a":1}` + strings.Repeat(`]}`, levels)
+	legacyFilter := strings.Repeat(`{ $and: [ `, levels) + `{ a: 1 }` + strings.Repeat(` ] }`, levels)
+	cfg := defaultConfig()
+	cfg.Minify = true
+	var got string
+	warnings := stderrOf(t, func() { got = run(t, cfg, entry("s.c", `{"find":"c","filter":`+filter+`,"$db":"s"}`)) })
+	contains(t, got, "db.getSiblingDB('s').c.find(", "/* ... */")
+	if n := strings.Count(warnings, "nested deeper than 100 levels truncated at stdin:1"); n != 1 { t.Errorf("got %d depth warnings, want 1:\n%s", n, warnings) }
+	legacy := `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command s.c command: find { find: "c", filter: ` + legacyFilter + `, $db: "s" } 150ms`
+	contains(t, run(t, cfg, legacy), "db.getSiblingDB('s').c.find("+legacyFilter+").explain()")
+	cfg.MaxDepth = 3
+	if warnings := stderrOf(t, func() { got = run(t, cfg, entry("s.c", `{"find":"c","filter":`+filter+`,"$db":"s"}`)) }); strings.Contains(warnings, "nested deeper") { t.Errorf("-max-depth cut warned: %s", warnings) }
+	contains(t, got, `{"$and":[{"$and":[ /* ... */ ]}]}`)
+	for _, tt := range []struct{ depth, ands int }{{150, 75}, {0, levels}} {
+		depth, ands := tt.depth, tt.ands
+		cfg.MaxDepth = depth
+		if warnings := stderrOf(t, func() { got = run(t, cfg, entry("s.c", `{"find":"c","filter":`+filter+`,"$db":"s"}`)) }); warnings != "" { t.Errorf("-max-depth %d warned: %s", depth, warnings) }
+		if n := strings.Count(got, `"$and"`); n != ands { t.Errorf("-max-depth %d rendered %d $and levels, want %d", depth, n, ands) }
+	}
+	contains(t, got, `{"a":1}`)
+	cfg.MaxDepth = -1
+	if err := convert(cfg, strings.NewReader(findEntry), io.Discard); err == nil { t.Error("convert accepted -max-depth -1") }
+}
+
+// TestExprAndJSONSchema checks that $expr and $jsonSchema, single-key
+// documents led by $, render as operators rather than type wrappers.
+func TestExprAndJSONSchema(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	for filter, want := range map[string]string{
+		`{"$expr":{"$gt":["$qty","$limit"]}}`:                                      `{"$expr":{"$gt":["$qty","$limit"]}}`,
+		`{"$expr":{"$eq":[{"$toLower":"$name"},"x"]}}`:                             `{"$expr":{"$eq":[{"$toLower":"$name"},"x"]}}`,
+		`{"$jsonSchema":{"required":["a"],"properties":{"a":{"bsonType":"int"}}}}`: `{"$jsonSchema":{"properties":{"a":{"bsonType":"int"}},"required":["a"]}}`,
+	} {
+		got := run(t, cfg, entry("s.c", `{"find":"c","filter":`+filter+`,"$db":"s"}`))
+		contains(t, got, "find("+want+")")
+	}
+}
+
+// TestCollectionRef checks that collection names which aren't JavaScript
+// identifiers are reached with getCollection(), in JSON and legacy input.
+func TestCollectionRef(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	for _, c := range []string{"with-dash", "123numeric", "a.b"} {
+		want := `db.getSiblingDB('s').getCollection("` + c + `").`
+		contains(t, run(t, cfg, entry("s."+c, `{"find":"`+c+`","filter":{"a":1},"$db":"s"}`)), want+"find(")
+		contains(t, run(t, cfg, entry("s."+c, `{"aggregate":"`+c+`","pipeline":[{"$match":{"a":1}}],"cursor":{},"$db":"s"}`)), want+"aggregate(")
+		contains(t, run(t, cfg, entry("s."+c, `{"update":"`+c+`","updates":[{"q":{"a":1},"u":{"$set":{"b":2}}}],"$db":"s"}`)), want+"updateOne(")
+		legacy := `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command s.` + c + ` command: find { find: "` + c + `", filter: { a: 1 }, $db: "s" } 150ms`
+		contains(t, run(t, cfg, legacy), want+"find({ a: 1 })")
+	}
+	contains(t, run(t, cfg, findEntry), "db.getSiblingDB('shop').orders.find(")
+}
+
+// TestNestedFacetIndent checks that a 4-level nested $facet and a $lookup
+// sub-pipeline indent one step per level, with every closing bracket lined
+// up under the line that opened it.
+func TestNestedFacetIndent(t *testing.T) {
+	facet := `{"$match":{"x":1}}`
+	for _, name := range []string{"d", "c", "b", "a"} { facet = `{"$facet":{"` + name + `":[` + facet + `]}}` }
+	lookup := `{"$lookup":{"from":"o","let":{"id":"$_id"},"pipeline":[{"$match":{"$expr":{"$eq":["$id","$$id"]}}},` + facet + `],"as":"j"}}`
+	for _, pipeline := range []string{facet, lookup} {
+		got := run(t, defaultConfig(), entry("s.c", `{"aggregate":"c","pipeline":[`+pipeline+`],"cursor":{},"$db":"s"}`))
+		query := strings.TrimSpace(strings.TrimSuffix(got, "---\n"))
+		if err := validateQuery(query); err != nil { t.Errorf("invalid shell: %v\n%s", err, query) }
+		depth := 0
+		for _, line := range strings.Split(query, "\n")[1:] {
+			trimmed := strings.TrimLeft(line, " ")
+			if strings.HasPrefix(trimmed, "]") || strings.HasPrefix(trimmed, "}") { depth-- }
+			if trimmed == ").explain()" { break }
+			if indent := len(line) - len(trimmed); indent != 2*depth { t.Fatalf("line %q indented %d, want %d:\n%s", line, indent, 2*depth, query) }
+			if strings.HasSuffix(trimmed, "[") || strings.HasSuffix(trimmed, "{") { depth++ }
+		}
+		if depth != 0 { t.Errorf("brackets unbalanced by %d:\n%s", depth, query) }
+	}
+}
+
+// TestPrettyLevelZero checks that rendering pretty at level 0, or below it,
+// indents from the margin instead of panicking on a negative repeat count.
+func TestPrettyLevelZero(t *testing.T) {
+	config = defaultConfig()
+	doc := map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": json.Number("1")}}}
+	want := "{\n  \"a\": [\n    {\n      \"b\": 1\n    }\n  ]\n}"
+	if got := toShellFormat(doc, true, 0); got != want { t.Errorf("level 0:\n%s\nwant:\n%s", got, want) }
+	if got := toShellFormat([]interface{}{json.Number("1")}, true, 0); got != "[\n  1\n]" { t.Errorf("level 0 array:\n%s", got) }
+	if got := toShellFormat(doc, true, -1); !strings.HasSuffix(got, "\n}") { t.Errorf("level -1:\n%s", got) }
+}
+
+// TestFunctionBody checks that the body of a $function in an $addFields
+// stage is written as a function, not a string.
+func TestFunctionBody(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, entry("s.c", `{"aggregate":"c","pipeline":[{"$addFields":{"h":{"$function":{"body":"function(n) { return n * 2 }","args":["$n"],"lang":"js"}}}}],"cursor":{},"$db":"s"}`))
+	contains(t, got, `[{"$addFields":{"h":{"$function":{"args":["$n"],"body":function(n) { return n * 2 },"lang":"js"}}}}]`)
+	if err := validateQuery(strings.TrimSpace(strings.TrimSuffix(got, "---\n"))); err != nil { t.Errorf("invalid shell: %v\n%s", err, got) }
+}
+
+// TestBucketAndWindowStages checks that $bucket, $bucketAuto and
+// $setWindowFields render as plain operators, with the boundaries and the
+// sortBy fields in their logged order.
+func TestBucketAndWindowStages(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	tests := []struct{ stage, want string }{
+		{`{"$bucket":{"groupBy":"$price","boundaries":[0,200,100],"default":"Other","output":{"count":{"$sum":1}}}}`, `{"$bucket":{"boundaries":[0,200,100],"default":"Other","groupBy":"$price","output":{"count":{"$sum":1}}}}`},
+		{`{"$bucketAuto":{"groupBy":"$p","buckets":4,"granularity":"R5"}}`, `{"$bucketAuto":{"buckets":4,"granularity":"R5","groupBy":"$p"}}`},
+		{`{"$setWindowFields":{"partitionBy":"$state","sortBy":{"orderDate":1,"a":-1},"output":{"cum":{"$sum":"$qty","window":{"documents":["unbounded","current"]}}}}}`, `{"$setWindowFields":{"output":{"cum":{"$sum":"$qty","window":{"documents":["unbounded","current"]}}},"partitionBy":"$state","sortBy":{"orderDate":1,"a":-1}}}`},
+	}
+	for _, tt := range tests {
+		got := run(t, cfg, entry("s.c", `{"aggregate":"c","pipeline":[`+tt.stage+`],"cursor":{},"$db":"s"}`))
+		contains(t, got, "aggregate(["+tt.want+"])")
+	}
+}
+
+// TestCanonicalDate checks that the canonical EJSON date form, epoch
+// milliseconds in a $numberLong, renders as an ISODate.
+func TestCanonicalDate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, entry("s.c", `{"find":"c","filter":{"d":{"$date":{"$numberLong":"1609459200000"}},"e":{"$gt":{"$date":{"$numberLong":"-1000"}}}},"$db":"s"}`))
+	contains(t, got, `{"d":ISODate("2021-01-01T00:00:00.000Z"),"e":{"$gt":ISODate("1969-12-31T23:59:59.000Z")}}`)
+}
+
+// TestPrettyArrayOfDocuments checks the exact pretty output of an array of
+// multi-field documents: every line of each element is indented alike.
+func TestPrettyArrayOfDocuments(t *testing.T) {
+	got := run(t, defaultConfig(), entry("s.c", `{"find":"c","filter":{"a":[{"x":1,"y":2},{"x":3,"y":4}]},"$db":"s"}`))
+	want := `db.getSiblingDB('s').c.find(
+{
+  "a": [
+    {
+      "x": 1,
+      "y": 2
+    },
+    {
+      "x": 3,
+      "y": 4
+    }
+  ]
+}
+).explain()
+`
+	if !strings.HasPrefix(got, want) { t.Errorf("got:\n%s\nwant:\n%s", got, want) }
+}
+
+// TestStringCommand checks that a command a log shipper stringified is
+// decoded and converted like any other.
+func TestStringCommand(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, entry("s.c", `"{\"find\":\"c\",\"filter\":{\"a\":1},\"$db\":\"s\"}"`))
+	contains(t, got, "db.getSiblingDB('s').c.find({\"a\":1}).explain()")
+	if stats.parsed != 1 { t.Errorf("parsed %d, want 1", stats.parsed) }
+}
+
+// TestCRLFAndBOM checks that CRLF line ends and a leading UTF-8 BOM are
+// stripped from JSON and legacy lines before they are decoded.
+func TestCRLFAndBOM(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	const bom = "\xef\xbb\xbf"
+	got := run(t, cfg, bom+entry("s.c", `{"find":"c","filter":{"a":1},"$db":"s"}`)+"\r\n"+entry("s.c", `{"find":"c","filter":{"b":1},"$db":"s"}`)+"\r\n")
+	if strings.Contains(got, "\r") { t.Errorf("output keeps a carriage return: %q", got) }
+	contains(t, got, "{\"a\":1}).explain()", "{\"b\":1}).explain()")
+	legacy := bom + `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command s.c command: find { find: "c", filter: { a: 1 }, $db: "s" } 150ms` + "\r\n"
+	if got := run(t, cfg, legacy); got != "db.getSiblingDB('s').c.find({ a: 1 }).explain()\n---\n" { t.Errorf("legacy: %q", got) }
+}
+
+// TestNumberLongPrecision checks that the largest 64-bit integer survives as
+// a NumberLong, whether the log quotes it or not, in a filter and in a find's
+// skip and limit.
+func TestNumberLongPrecision(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, entry("s.c", `{"find":"c","filter":{"a":{"$numberLong":"9223372036854775807"},"b":{"$numberLong":9223372036854775807},"c":9223372036854775807},"$db":"s"}`))
+	contains(t, got, `{"a":NumberLong("9223372036854775807"),"b":NumberLong("9223372036854775807"),"c":9223372036854775807}`)
+	got = run(t, cfg, entry("s.c", `{"find":"c","filter":{},"skip":{"$numberLong":"9223372036854775807"},"limit":{"$numberLong":"5"},"$db":"s"}`))
+	contains(t, got, `.skip(NumberLong("9223372036854775807")).limit(NumberLong("5"))`)
+}
+
+// TestMergeCursorsPipeline checks that the merging half of a sharded
+// aggregate, logged with a $mergeCursors stage, converts to the user-facing
+// stages after it, also when wrapped in an explain.
+func TestMergeCursorsPipeline(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	merge := `{"$mergeCursors":{"sort":{"a":1},"compareWholeSortKey":false,"remotes":[{"shardId":"sh0","hostAndPort":"h:1","cursorResponse":{"cursor":{"id":1,"ns":"s.c"}}}]}}`
+	got := run(t, cfg, entry("s.c", `{"aggregate":"c","pipeline":[`+merge+`,{"$group":{"_id":"$k","n":{"$sum":1}}}],"cursor":{"batchSize":0},"$db":"s"}`))
+	contains(t, got, "// $mergeCursors removed", "aggregate([{\"$group\":{\"_id\":\"$k\",\"n\":{\"$sum\":1}}}],")
+	if strings.Contains(got, "remotes") { t.Errorf("shard cursors kept:\n%s", got) }
+	got = run(t, cfg, entry("s.c", `{"explain":{"aggregate":"c","pipeline":[`+merge+`,{"$match":{"a":1}}],"cursor":{}},"$db":"s"}`))
+	contains(t, got, "// $mergeCursors removed", "aggregate([{\"$match\":{\"a\":1}}]).explain()")
+}
+
+// TestGraphLookup checks that $graphLookup lists its fields in their
+// documented order, with the startWith field reference quoted.
+func TestGraphLookup(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, entry("s.c", `{"aggregate":"c","pipeline":[{"$graphLookup":{"as":"chain","connectFromField":"reportsTo","connectToField":"name","depthField":"d","from":"emp","maxDepth":3,"restrictSearchWithMatch":{"active":true},"startWith":"$reportsTo"}}],"cursor":{},"$db":"s"}`))
+	contains(t, got, `[{"$graphLookup":{"from":"emp","startWith":"$reportsTo","connectFromField":"reportsTo","connectToField":"name","as":"chain","maxDepth":3,"depthField":"d","restrictSearchWithMatch":{"active":true}}}]`)
+}
+
+// TestBlankLines checks that empty and whitespace-only lines produce no
+// output, no warnings and no unparsed entries.
+func TestBlankLines(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Strict, cfg.WarnTruncated = true, true
+	var got string
+	warnings := stderrOf(t, func() { got = run(t, cfg, "\n   \n\t\r\n\n") })
+	if got != "" || warnings != "" { t.Errorf("blank lines gave output %q, warnings %q", got, warnings) }
+	if stats.unparsed != 0 || stats.json != 0 || stats.legacy != 0 { t.Errorf("blank lines counted: %d unparsed, %d json, %d legacy", stats.unparsed, stats.json, stats.legacy) }
+	cfg.Minify = true
+	contains(t, run(t, cfg, "\n  \n"+findEntry+"\n\n"), "db.getSiblingDB('shop').orders.find({\"status\":\"A\"})")
+}
+
+// TestOutForms checks that $out renders in both its collection and its
+// document form, and that -suggest names the namespace each writes to.
+func TestOutForms(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify, cfg.Suggest = true, true
+	tests := []struct{ out, rendered, target string }{
+		{`"t"`, `{"$out":"t"}`, "s.t"},
+		{`{"db":"o","coll":"t"}`, `{"$out":{"coll":"t","db":"o"}}`, "o.t"},
+	}
+	for _, tt := range tests {
+		got := run(t, cfg, entry("s.c", `{"aggregate":"c","pipeline":[{"$match":{"a":1}},{"$out":`+tt.out+`}],"cursor":{},"$db":"s"}`))
+		contains(t, got, `[{"$match":{"a":1}},`+tt.rendered+`]`, "// note: the pipeline writes to "+tt.target+"\n")
+	}
+}
+
+// TestLegacyCommandAnchor checks that a legacy line is converted from the
+// command that introduces it, not from command-like text quoted in the
+// appName or a comment.
+func TestLegacyCommandAnchor(t *testing.T) {
+	line := `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command s.c appName: "etl command: aggregate { }" command: find { find: "c", filter: { a: 1 }, comment: "see command: find { b: 2 }", $db: "s" } planSummary: COLLSCAN 150ms`
+	got := run(t, defaultConfig(), line)
+	if !strings.HasPrefix(got, "db.getSiblingDB('s').c.find({ a: 1 }).explain()") { t.Errorf("got:\n%s", got) }
+}
+
+// TestStableOrdering checks that -group-by-ns, -count-only and the run
+// summary print the same thing on every run: namespaces sorted, counts
+// highest first.
+func TestStableOrdering(t *testing.T) {
+	input := strings.Join([]string{
+		entry("b.z", `{"find":"z","filter":{"a":1},"$db":"b"}`),
+		entry("a.y", `{"find":"y","filter":{"a":1},"$db":"a"}`),
+		entry("b.a", `{"aggregate":"a","pipeline":[],"cursor":{},"$db":"b"}`),
+		entry("a.y", `{"find":"y","filter":{"b":1},"$db":"a"}`),
+		entry("a.y", `{"aggregate":"y","pipeline":[],"cursor":{},"$db":"a"}`),
+	}, "\n")
+	grouped, counted := defaultConfig(), defaultConfig()
+	grouped.Minify, grouped.GroupByNS = true, true
+	counted.CountOnly = true
+	var first []string
+	for i := 0; i < 10; i++ {
+		var summary bytes.Buffer
+		got := []string{run(t, grouped, input), run(t, counted, input)}
+		printStats(&summary)
+		got = append(got, summary.String())
+		if first == nil { first = got; continue }
+		for j := range got {
+			if got[j] != first[j] { t.Fatalf("run %d differs:\n%s\nfirst run:\n%s", i, got[j], first[j]) }
+		}
+	}
+	order := func(s string, parts ...string) {
+		t.Helper()
+		last := -1
+		for _, p := range parts {
+			i := strings.Index(s, p)
+			if i <= last { t.Errorf("%q out of order in:\n%s", p, s) }
+			last = i
+		}
+	}
+	order(first[0], "// === a.y ===", "// === b.a ===", "// === b.z ===")
+	order(first[1], "a.y        find", "a.y        aggregate", "b.a        aggregate", "b.z        find")
+	order(first[2], "aggregate:      2", "find:           3")
+}
+
+// TestUnionWith checks that a $unionWith sub-pipeline renders as a pipeline
+// and that -ns also matches the collections $unionWith and $lookup read.
+func TestUnionWith(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	union := `{"aggregate":"c","pipeline":[{"$unionWith":{"coll":"archive","pipeline":[{"$match":{"y":2024}},{"$project":{"a":1,"_id":0}}]}}],"cursor":{},"$db":"s"}`
+	contains(t, run(t, cfg, entry("s.c", union)), `[{"$unionWith":{"coll":"archive","pipeline":[{"$match":{"y":2024}},{"$project":{"_id":0,"a":1}}]}}]`)
+	inputs := map[string]string{
+		"union":        union,
+		"union string": `{"aggregate":"c","pipeline":[{"$unionWith":"archive"}],"cursor":{},"$db":"s"}`,
+		"lookup":       `{"aggregate":"c","pipeline":[{"$lookup":{"from":"archive","localField":"a","foreignField":"b","as":"j"}}],"cursor":{},"$db":"s"}`,
+		"in facet":     `{"aggregate":"c","pipeline":[{"$facet":{"f":[{"$unionWith":{"coll":"archive","pipeline":[]}}]}}],"cursor":{},"$db":"s"}`,
+	}
+	cfg.NamespaceGlob = "s.arch*"
+	for name, command := range inputs {
+		if got := run(t, cfg, entry("s.c", command)); !strings.Contains(got, "db.getSiblingDB('s').c.aggregate(") { t.Errorf("%s: -ns s.arch* skipped a pipeline reading s.archive:\n%s", name, got) }
+	}
+	if got := run(t, cfg, findEntry); got != "" { t.Errorf("-ns s.arch* kept:\n%s", got) }
+}
+
+// TestDBRef checks that a DBRef, with or without its $db, renders as a
+// DBRef() call with its $id wrapper converted too.
+func TestDBRef(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	oid := `{"$oid":"5f1d7f0e8c4b2a0011223344"}`
+	contains(t, run(t, cfg, entry("s.c", `{"find":"c","filter":{"owner":{"$ref":"users","$id":`+oid+`,"$db":"app"}},"$db":"s"}`)), `{"owner":DBRef("users", ObjectId("5f1d7f0e8c4b2a0011223344"), "app")}`)
+	contains(t, run(t, cfg, entry("s.c", `{"find":"c","filter":{"owner":{"$ref":"users","$id":`+oid+`}},"$db":"s"}`)), `{"owner":DBRef("users", ObjectId("5f1d7f0e8c4b2a0011223344"))}`)
+}
+
+// TestChangeStream checks that a pipeline led by $changeStream becomes a
+// watch() call, on the collection or on the whole database.
+func TestChangeStream(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, entry("s.c", `{"aggregate":"c","pipeline":[{"$changeStream":{"fullDocument":"updateLookup"}},{"$match":{"operationType":"insert"}}],"cursor":{},"$db":"s"}`))
+	want := "// change stream: reconstructed with watch() rather than aggregate()\ndb.getSiblingDB('s').c.watch([{\"$match\":{\"operationType\":\"insert\"}}],{\"fullDocument\":\"updateLookup\"})\n"
+	if !strings.HasPrefix(got, want) { t.Errorf("got:\n%s\nwant:\n%s", got, want) }
+	contains(t, run(t, cfg, entry("s.$cmd.aggregate", `{"aggregate":1,"pipeline":[{"$changeStream":{}}],"cursor":{},"$db":"s"}`)), "db.getSiblingDB('s').watch([])")
+}
+
+// TestPipelineUpdate checks that an update whose u is an aggregation
+// pipeline is rendered, and marked, as one.
+func TestPipelineUpdate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, entry("s.c", `{"update":"c","updates":[{"q":{"a":1},"u":[{"$set":{"t":{"$add":["$x","$y"]}}},{"$unset":"tmp"}],"multi":true}],"$db":"s"}`))
+	want := "// update with an aggregation pipeline\ndb.getSiblingDB('s').c.updateMany({\"a\":1},[{\"$set\":{\"t\":{\"$add\":[\"$x\",\"$y\"]}}},{\"$unset\":\"tmp\"}])\n"
+	if !strings.HasPrefix(got, want) { t.Errorf("got:\n%s\nwant:\n%s", got, want) }
+	contains(t, run(t, cfg, entry("s.c", `{"update":"c","updates":[{"q":{"a":1},"u":[{"$set":{"t":1}}]}],"$db":"s"}`)), "updateOne({\"a\":1},[{\"$set\":{\"t\":1}}])")
+}
+
+// TestLegacyHint checks that a legacy find keeps its hint, by index name or
+// by key pattern.
+func TestLegacyHint(t *testing.T) {
+	for hint, want := range map[string]string{`"a_1"`: `.hint("a_1")`, `{ a: 1, b: -1 }`: `.hint({ a: 1, b: -1 })`} {
+		line := `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command s.c command: find { find: "c", filter: { a: 1 }, hint: ` + hint + `, $db: "s" } 150ms`
+		contains(t, run(t, defaultConfig(), line), "db.getSiblingDB('s').c.find({ a: 1 })"+want+".explain()")
+	}
+}
+
+// TestRegexOperator checks that the {$regex, $options} operator form stays a
+// document, and valid shell, unless -collapse-regex is set.
+func TestRegexOperator(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	filter := `{"m":{"$regex":"x"},"n":{"$regex":"^ab","$options":"i"}}`
+	for collapse, want := range map[bool]string{false: `{"m":{"$regex":"x"},"n":{"$options":"i","$regex":"^ab"}}`, true: `{"m":/x/,"n":/^ab/i}`} {
+		cfg.CollapseRegex = collapse
+		got := run(t, cfg, entry("s.c", `{"find":"c","filter":`+filter+`,"$db":"s"}`))
+		contains(t, got, "find("+want+")")
+		if err := validateQuery(strings.TrimSpace(strings.TrimSuffix(got, "---\n"))); err != nil { t.Errorf("invalid shell: %v\n%s", err, got) }
+	}
+}
+
+// TestDottedPathKeys checks that dotted-path keys in $set, $addFields,
+// $project and update documents render quoted and unaltered, in JSON and
+// legacy input.
+func TestDottedPathKeys(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, entry("s.c", `{"aggregate":"c","pipeline":[{"$set":{"a.b.c":1}},{"$addFields":{"x.y":"$z.w"}},{"$project":{"p.q":1,"_id":0}}],"cursor":{},"$db":"s"}`))
+	contains(t, got, `[{"$set":{"a.b.c":1}},{"$addFields":{"x.y":"$z.w"}},{"$project":{"_id":0,"p.q":1}}]`)
+	got = run(t, cfg, entry("s.c", `{"update":"c","updates":[{"q":{"a.b":1},"u":{"$set":{"a.b.c":1,"items.$[e].qty":2}}}],"$db":"s"}`))
+	contains(t, got, "{\"a.b\":1},{\"$set\":{\"a.b.c\":1,\"items.$[e].qty\":2}}")
+	legacy := `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command s.c command: aggregate { aggregate: "c", pipeline: [ { $set: { a.b.c: 1 } }, { $project: { p.q: 1 } } ], cursor: {}, $db: "s" } 150ms`
+	contains(t, run(t, cfg, legacy), `[ { $set: { "a.b.c": 1 } }, { $project: { "p.q": 1 } } ]`)
+}
+
+// TestLegacyFields checks that a legacy find logging its projection under
+// fields keeps it, and that projection wins when both are logged.
+func TestLegacyFields(t *testing.T) {
+	line := `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command s.c command: find { find: "c", filter: { a: 1 }, fields: { a: 1, _id: 0 }, $db: "s" } 150ms`
+	contains(t, run(t, defaultConfig(), line), "db.getSiblingDB('s').c.find({ a: 1 }, { a: 1, _id: 0 }).explain()")
+	line = `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command s.c command: find { find: "c", filter: { a: 1 }, projection: { b: 1 }, fields: { a: 1 }, $db: "s" } 150ms`
+	contains(t, run(t, defaultConfig(), line), "db.getSiblingDB('s').c.find({ a: 1 }, { b: 1 }).explain()")
+}
+
+// TestViewNamespace checks that a query logged on a view's namespace is
+// converted on the logged ns, with a comment naming the collection the
+// command gives.
+func TestViewNamespace(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, entry("s.activeUsers", `{"find":"users","filter":{"a":1},"$db":"s"}`))
+	want := "// command names collection \"users\", logged on s.activeUsers (a view?)\ndb.getSiblingDB('s').activeUsers.find("
+	if !strings.HasPrefix(got, want) { t.Errorf("got:\n%s\nwant:\n%s", got, want) }
+	if got := run(t, cfg, findEntry); strings.Contains(got, "a view?") { t.Errorf("matching ns noted:\n%s", got) }
+}
+
+// TestSlowGetMore checks that a slow getMore is converted as the query that
+// opened its cursor, with a comment that the duration is the getMore's.
+func TestSlowGetMore(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	line := `{"t":{"$date":"2024-10-01T10:00:00.000+00:00"},"msg":"Slow query","attr":{"ns":"s.c","command":{"getMore":123,"collection":"c","$db":"s"},"originatingCommand":{"find":"c","filter":{"a":1},"batchSize":2,"$db":"s"},"durationMillis":900}}`
+	got := run(t, cfg, line)
+	want := "// getMore: the originating query of the cursor; the duration is the getMore's, not this query's\ndb.getSiblingDB('s').c.find({\"a\":1}).batchSize(2).explain()\n"
+	if !strings.HasPrefix(got, want) { t.Errorf("got:\n%s\nwant:\n%s", got, want) }
+	noOrigin := `{"t":{"$date":"2024-10-01T10:00:00.000+00:00"},"msg":"Slow query","attr":{"ns":"s.c","command":{"getMore":123,"collection":"c","$db":"s"},"durationMillis":900}}`
+	if got := run(t, cfg, noOrigin); got != "" || stats.unparsed != 1 { t.Errorf("getMore without originatingCommand: %d unparsed, output %q", stats.unparsed, got) }
+}
+
+// TestStringPipeline checks that a pipeline a log shipper stringified is
+// decoded and rendered as stages.
+func TestStringPipeline(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, entry("s.c", `{"aggregate":"c","pipeline":"[{\"$match\":{\"a\":1}},{\"$sort\":{\"b\":-1,\"a\":1}}]","cursor":{},"$db":"s"}`))
+	contains(t, got, "aggregate([{\"$match\":{\"a\":1}},{\"$sort\":{\"b\":-1,\"a\":1}}])")
+}
+
+// TestAttributesAlias checks that an entry whose attr was renamed to
+// attributes converts like any other.
+func TestAttributesAlias(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, `{"t":{"$date":"2024-10-01T10:00:00.000+00:00"},"msg":"Slow query","attributes":{"ns":"s.c","command":{"find":"c","filter":{"a":1},"$db":"s"},"durationMillis":150}}`)
+	contains(t, got, "db.getSiblingDB('s').c.find({\"a\":1}).explain()")
+	if stats.json != 1 || stats.parsed != 1 { t.Errorf("%d json entries, %d parsed; want 1, 1", stats.json, stats.parsed) }
+}
+
+// TestMetaProjection checks that $meta, a single-key document led by $,
+// renders as an operator in projections and sorts.
+func TestMetaProjection(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, entry("s.c", `{"find":"c","filter":{"$text":{"$search":"x"}},"projection":{"score":{"$meta":"textScore"},"k":{"$meta":"indexKey"}},"sort":{"score":{"$meta":"textScore"}},"$db":"s"}`))
+	contains(t, got, "{\"$text\":{\"$search\":\"x\"}},{\"k\":{\"$meta\":\"indexKey\"},\"score\":{\"$meta\":\"textScore\"}}).sort({\"score\":{\"$meta\":\"textScore\"}})")
+}
+
+// TestDateOperators checks that $dateToString keeps its format string and
+// field references exactly and $dateFromParts lists its parts from the year
+// down, in a runnable $project stage.
+func TestDateOperators(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, entry("s.c", `{"aggregate":"c","pipeline":[{"$project":{"day":{"$dateToString":{"format":"%Y-%m-%d %H:%M","date":"$ts","timezone":"Europe/Helsinki"}},"d":{"$dateFromParts":{"day":"$d","month":"$m","year":"$y","hour":0}}}}],"cursor":{},"$db":"s"}`))
+	contains(t, got, `[{"$project":{"d":{"$dateFromParts":{"year":"$y","month":"$m","day":"$d","hour":0}},"day":{"$dateToString":{"date":"$ts","format":"%Y-%m-%d %H:%M","timezone":"Europe/Helsinki"}}}}]`)
+	if err := validateQuery(strings.TrimSpace(strings.TrimSuffix(got, "---\n"))); err != nil { t.Errorf("invalid shell: %v\n%s", err, got) }
+}
+
+// TestFindAndModify checks that findAndModify becomes findOneAndUpdate with
+// its update, or findOneAndDelete without one for remove, with new mapped
+// to returnDocument only where it applies.
+func TestFindAndModify(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	tests := []struct{ name, command, want string }{
+		{"update new", `{"findAndModify":"c","query":{"a":1},"update":{"$inc":{"n":1}},"new":true,"upsert":true,"$db":"s"}`, "findOneAndUpdate({\"a\":1},{\"$inc\":{\"n\":1}},{\"returnDocument\":\"after\",\"upsert\":true})"},
+		{"update", `{"findAndModify":"c","query":{"a":1},"update":{"$set":{"n":1}},"fields":{"n":1},"$db":"s"}`, "findOneAndUpdate({\"a\":1},{\"$set\":{\"n\":1}},{\"projection\":{\"n\":1}})"},
+		{"remove", `{"findAndModify":"c","query":{"a":1},"remove":true,"sort":{"t":1},"$db":"s"}`, "findOneAndDelete({\"a\":1},{\"sort\":{\"t\":1}})"},
+		{"remove new", `{"findAndModify":"c","query":{"a":1},"remove":true,"new":true,"$db":"s"}`, "findOneAndDelete({\"a\":1})"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := run(t, cfg, entry("s.c", tt.command))
+			if !strings.HasPrefix(got, "db.getSiblingDB('s').c."+tt.want) { t.Errorf("got:\n%s\nwant:\n%s", got, tt.want) }
+		})
+	}
+}
+
+// TestLegacyNumberWrappers checks that a legacy limit or skip logged as a
+// NumberLong or NumberInt still reaches .limit() and .skip().
+func TestLegacyNumberWrappers(t *testing.T) {
+	for limit, want := range map[string]string{"NumberLong(50)": "50", `NumberLong("50")`: "50", "NumberInt(7)": "7", "50": "50"} {
+		line := `2019-03-01T12:36:56.789+0000 I COMMAND  [conn3] command s.c command: find { find: "c", filter: { a: 1 }, limit: ` + limit + `, skip: NumberInt(3), $db: "s" } 150ms`
+		contains(t, run(t, defaultConfig(), line), "db.getSiblingDB('s').c.find({ a: 1 }).skip(3).limit("+want+").explain()")
+	}
+}
+
+// TestMinify checks the exact -minify form, without a space after colons or
+// commas, against the spaced compact form, and that every kind of statement
+// is written on one line.
+func TestMinify(t *testing.T) {
+	command := `{"find":"c","filter":{"a":1,"b":[1,2],"c":{"d":"x, y"}},"projection":{"a":1},"$db":"s"}`
+	cfg := defaultConfig()
+	cfg.Minify = true
+	if got, want := run(t, cfg, entry("s.c", command)), "db.getSiblingDB('s').c.find({\"a\":1,\"b\":[1,2],\"c\":{\"d\":\"x, y\"}},{\"a\":1}).explain()\n---\n"; got != want { t.Errorf("-minify:\n%s\nwant:\n%s", got, want) }
+	for _, command := range []string{
+		`{"find":"c","filter":{"a":1},"let":{"v":1},"sort":{"b":1},"$db":"s"}`,
+		`{"aggregate":"c","pipeline":[{"$match":{"a":1}}],"cursor":{"batchSize":5},"$db":"s"}`,
+		`{"update":"c","updates":[{"q":{"a":1},"u":{"$set":{"b":1}},"upsert":true}],"$db":"s"}`,
+		`{"delete":"c","deletes":[{"q":{"a":1},"limit":1}],"writeConcern":{"w":1},"$db":"s"}`,
+		`{"findAndModify":"c","query":{"a":1},"update":{"$inc":{"n":1}},"new":true,"$db":"s"}`,
+		`{"findAndModify":"c","query":{"a":1},"remove":true,"sort":{"t":1},"$db":"s"}`,
+		`{"mapReduce":"c","map":"function() { emit(this.k, 1) }","reduce":"function(k, v) { return v.length }","out":{"inline":1},"$db":"s"}`,
+		`{"bulkWrite":1,"ops":[{"insert":0,"document":{"_id":1}},{"update":0,"filter":{"_id":1},"updateMods":{"$set":{"a":1}}}],"nsInfo":[{"ns":"s.c"}],"$db":"admin"}`,
+	} {
+		got := run(t, cfg, entry("s.c", command))
+		if got == "" { t.Errorf("no output for %s", command) }
+		for _, statement := range strings.Split(strings.TrimSuffix(got, "---\n"), "---\n") {
+			if n := strings.Count(strings.TrimSuffix(statement, "\n"), "\n"); n != 0 { t.Errorf("-minify statement spans %d lines:\n%s", n+1, statement) }
+		}
+	}
+	cfg = defaultConfig()
+	cfg.PrettyThreshold = 1000
+	contains(t, run(t, cfg, entry("s.c", command)), `{ "a": 1, "b": [1, 2], "c": { "d": "x, y" } }`)
+}
+
+// TestNaturalHint checks that a $natural hint renders as logged and that
+// -suggest warns it forces a collection scan, in the direction it names.
+func TestNaturalHint(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	command := `{"find":"c","filter":{"a":1},"hint":{"$natural":-1},"$db":"s"}`
+	got := run(t, cfg, entry("s.c", command))
+	contains(t, got, "{\"a\":1}).hint({\"$natural\":-1}).explain()")
+	if strings.Contains(got, "COLLSCAN") { t.Errorf("warned without -suggest:\n%s", got) }
+	cfg.Suggest = true
+	contains(t, run(t, cfg, entry("s.c", command)), "// WARNING: the $natural hint forces a COLLSCAN in reverse natural order, whatever indexes exist\n")
+	contains(t, run(t, cfg, entry("s.c", `{"find":"c","filter":{"a":1},"hint":{"$natural":1},"$db":"s"}`)), ").hint({\"$natural\":1})", "forces a COLLSCAN")
+}
+
+// TestMultilineJSON checks that -multiline-json reads a pretty-printed entry
+// spanning many lines as well as the NDJSON entries around it.
+func TestMultilineJSON(t *testing.T) {
+	pretty := `{
+  "t": {"$date": "2024-10-01T10:00:00.000+00:00"},
+  "msg": "Slow query",
+  "attr": {
+    "ns": "s.c",
+    "command": {
+      "find": "c",
+      "filter": {"a": 1},
+      "$db": "s"
+    },
+    "durationMillis": 150
+  }
+}`
+	cfg := defaultConfig()
+	cfg.Minify, cfg.MultilineJSON = true, true
+	got := run(t, cfg, findEntry+"\n"+pretty+"\n"+findEntry+"\n")
+	contains(t, got, "db.getSiblingDB('s').c.find({\"a\":1}).explain()")
+	if n := strings.Count(got, "---\n"); n != 3 || stats.json != 3 || stats.unparsed != 0 { t.Errorf("%d queries, %d json entries, %d unparsed; want 3, 3, 0:\n%s", n, stats.json, stats.unparsed, got) }
+	cfg.MultilineJSON = false
+	if got := run(t, cfg, pretty); got != "" { t.Errorf("pretty-printed entry converted line by line:\n%s", got) }
+}
+
+// TestSample checks that a $sample stage renders with its size and that only
+// -suggest notes its random cursor.
+func TestSample(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	command := `{"aggregate":"c","pipeline":[{"$match":{"a":1}},{"$sample":{"size":5}}],"cursor":{},"$db":"s"}`
+	const note = "// note: $sample picks documents with a random cursor and doesn't use indexes on the sampled collection"
+	got := run(t, cfg, entry("s.c", command))
+	contains(t, got, `[{"$match":{"a":1}},{"$sample":{"size":5}}]`)
+	if strings.Contains(got, "$sample picks") { t.Errorf("noted without -suggest:\n%s", got) }
+	cfg.Suggest = true
+	contains(t, run(t, cfg, entry("s.c", command)), `{"$sample":{"size":5}}`, note+"\n")
+}
+
+// TestNonStringOID checks that only a string $oid becomes an ObjectId; a
+// malformed one renders as the document it is.
+func TestNonStringOID(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Minify = true
+	got := run(t, cfg, entry("s.c", `{"find":"c","filter":{"a":{"$oid":{"x":1}},"b":{"$oid":"5f1d7f0e8c4b2a0011223344"},"n":{"$oid":5}},"$db":"s"}`))
+	contains(t, got, `{"a":{"$oid":{"x":1}},"b":ObjectId("5f1d7f0e8c4b2a0011223344"),"n":{"$oid":5}}`)
+	if strings.Contains(got, "map[") { t.Errorf("output has a Go map:\n%s", got) }
+}